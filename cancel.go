@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// exitInterrupted is the exit code after SIGINT/SIGTERM, as for shells (128 + SIGINT)
+const exitInterrupted = 130
+
+// killTimeout bounds how long KILL QUERY may take after a statement was abandoned
+const killTimeout = 10 * time.Second
+
+// errInterrupted is returned for statements abandoned because the run was cancelled
+var errInterrupted = errors.New("interrupted")
+
+// statementTimeoutError is returned for statements abandoned after their -- timeout:.
+// The driver reports such statements with whatever error the deadline caused, often
+// a network timeout, which must not be retried.
+type statementTimeoutError struct {
+	timeout time.Duration
+	queryID string
+	err     error
+}
+
+func (e *statementTimeoutError) Error() string {
+	return fmt.Sprintf("exceeded the %s timeout (query_id %s): %v", e.timeout, e.queryID, e.err)
+}
+
+func (e *statementTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// statementQueryIDKey is the context key for the query ID of a statement
+type statementQueryIDKey struct{}
+
+// withQueryID returns a context that makes the executor tag its statement with id
+func withQueryID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, statementQueryIDKey{}, id)
+}
+
+// statementQueryID returns the query ID attached with withQueryID, if any
+func statementQueryID(ctx context.Context) string {
+	id, _ := ctx.Value(statementQueryIDKey{}).(string)
+	return id
+}
+
+// newQueryID returns a random UUID to tag a statement or run with
+func newQueryID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // Version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	h := hex.EncodeToString(b[:])
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
+
+// runIDKey is the context key for the ID of the current run
+type runIDKey struct{}
+
+// withRunID returns a context whose statements get query IDs derived from the run ID
+func withRunID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, runIDKey{}, id)
+}
+
+// contextRunID returns the run ID attached with withRunID, if any
+func contextRunID(ctx context.Context) string {
+	id, _ := ctx.Value(runIDKey{}).(string)
+	return id
+}
+
+// statementQueryIDFor returns the deterministic query ID of a statement in the run of ctx,
+// <run ID>-<part>-..., e.g. 3f2b...-2.0.5-3 for the third statement of version 2.0.5.
+// Without a run ID it returns "" and executeStatement falls back to a random ID.
+func statementQueryIDFor(ctx context.Context, parts ...string) string {
+	id := contextRunID(ctx)
+	if id == "" {
+		return ""
+	}
+	return strings.Join(append([]string{id}, parts...), "-")
+}
+
+// logComment is sent as the log_comment setting so statements can be found in
+// system.query_log, e.g. WHERE JSONExtractString(log_comment, 'file') = '002_users.sql'
+type logComment struct {
+	Tool      string `json:"tool"`
+	RunID     string `json:"run_id,omitempty"`
+	File      string `json:"file"`
+	Version   string `json:"version,omitempty"`
+	Statement int    `json:"statement,omitempty"`
+	Table     string `json:"table,omitempty"`
+}
+
+func (c logComment) String() string {
+	c.Tool = "dbmigrate"
+	data, _ := json.Marshal(c)
+	return string(data)
+}
+
+// statementOptions controls how executeStatement runs a statement
+type statementOptions struct {
+	settings   map[string]string
+	timeout    time.Duration // 0 = none
+	retry      retryPolicy
+	retrySafe  bool   // Retry even statements that do not look idempotent (-- retry: safe)
+	queryID    string // "" = random; retries append -retryN
+	logComment string // Sent as the log_comment setting unless settings has one
+}
+
+// effectiveSettings returns the settings to send: opts.settings plus the log_comment,
+// unless the settings already have one
+func (opts statementOptions) effectiveSettings() map[string]string {
+	if _, ok := opts.settings["log_comment"]; opts.logComment == "" || ok {
+		return opts.settings
+	}
+	settings := make(map[string]string, len(opts.settings)+1)
+	for name, value := range opts.settings {
+		settings[name] = value
+	}
+	settings["log_comment"] = opts.logComment
+	return settings
+}
+
+// executeStatement executes one statement under ctx, retrying transient errors as allowed
+// by opts. The returned error reads as a continuation of "statement N", e.g.
+// "failed (query_id ...): ..." or "interrupted".
+func executeStatement(ctx context.Context, executor DatabaseExecutor, sql string, opts statementOptions, logger *Logger) error {
+	for retry := 0; ; retry++ {
+		err := executeAttempt(ctx, executor, sql, opts, retry, logger)
+		if err == nil || errors.Is(err, errInterrupted) || retry >= opts.retry.Retries || !isRetryable(err) {
+			return err
+		}
+		if !opts.retrySafe && !isIdempotent(sql) {
+			logger.Verbosef("  Not retrying a statement that may not be idempotent (mark the file with -- retry: safe to allow it)")
+			return err
+		}
+
+		delay := opts.retry.delay(retry)
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(
+			attribute.Int("dbmigrate.retry", retry+1),
+			attribute.String("dbmigrate.retry.reason", retryDescription(err)),
+		))
+		logger.Warnf("Statement hit %s, retrying in %s (retry %d of %d)", retryDescription(err), delay, retry+1, opts.retry.Retries)
+		if err := waitRetry(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// executeAttempt executes a statement once, tagged with its query ID and with the
+// settings and timeout from opts. When the client gives up on the statement, because
+// ctx was cancelled or the timeout expired, the server is asked to KILL the query so
+// it does not keep running.
+func executeAttempt(ctx context.Context, executor DatabaseExecutor, sql string, opts statementOptions, retry int, logger *Logger) error {
+	if ctx.Err() != nil {
+		return errInterrupted
+	}
+
+	queryID := opts.queryID
+	if queryID == "" {
+		queryID = newQueryID()
+	} else if retry > 0 {
+		queryID = fmt.Sprintf("%s-retry%d", queryID, retry)
+	}
+
+	stmtCtx := withQueryID(withStatementSettings(ctx, opts.effectiveSettings()), queryID)
+	cancel := context.CancelFunc(func() {})
+	if opts.timeout > 0 {
+		stmtCtx, cancel = context.WithTimeout(stmtCtx, opts.timeout)
+	}
+	defer cancel()
+
+	logger.Debugf("  Query ID %s", queryID)
+	err := executor.Execute(stmtCtx, sql)
+	switch {
+	case err == nil:
+		return nil
+	case ctx.Err() != nil:
+		killQuery(executor, queryID, logger)
+		return errInterrupted
+	case errors.Is(stmtCtx.Err(), context.DeadlineExceeded):
+		killQuery(executor, queryID, logger)
+		return &statementTimeoutError{timeout: opts.timeout, queryID: queryID, err: err}
+	default:
+		return fmt.Errorf("failed (query_id %s): %w", queryID, err)
+	}
+}
+
+// killQuery asks the server to stop a statement the client abandoned
+func killQuery(executor DatabaseExecutor, queryID string, logger *Logger) {
+	ctx, cancel := context.WithTimeout(ctxbg, killTimeout)
+	defer cancel()
+
+	if err := executor.KillQuery(ctx, queryID); err != nil {
+		logger.Warnf("Could not kill query %s: %v", queryID, err)
+		return
+	}
+	logger.Verbosef("  Killed query %s", queryID)
+}
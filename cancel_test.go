@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// interruptExecutor cancels the run when it sees a statement containing trigger, then
+// blocks that statement until its context ends, like a long-running server query
+type interruptExecutor struct {
+	MockExecutor
+	trigger  string
+	cancel   context.CancelFunc
+	queryIDs []string
+}
+
+func (m *interruptExecutor) Execute(ctx context.Context, sql string) error {
+	if id := statementQueryID(ctx); id != "" {
+		m.queryIDs = append(m.queryIDs, id)
+	}
+	if m.trigger != "" && strings.Contains(sql, m.trigger) {
+		m.cancel()
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return m.MockExecutor.Execute(ctx, sql)
+}
+
+func (m *interruptExecutor) Query(ctx context.Context, sql string) ([]map[string]interface{}, error) {
+	if strings.Contains(sql, "system.columns") {
+		return []map[string]interface{}{{"name": "status"}, {"name": "duration_ms"}}, nil
+	}
+	return nil, nil
+}
+
+// ============================================================================
+// Tests for query IDs and executeStatement
+// ============================================================================
+
+func TestNewQueryID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first, second := newQueryID(), newQueryID()
+	if !uuid.MatchString(first) {
+		t.Errorf("expected a UUID, got %q", first)
+	}
+	if first == second {
+		t.Errorf("expected unique query IDs, got %q twice", first)
+	}
+}
+
+func TestExecuteStatementTagsQueryID(t *testing.T) {
+	mock := &interruptExecutor{}
+
+	if err := executeStatement(ctxbg, mock, "SELECT 1", statementOptions{}, testLogger(&bytes.Buffer{})); err != nil {
+		t.Fatalf("executeStatement failed: %v", err)
+	}
+	if len(mock.queryIDs) != 1 || mock.queryIDs[0] == "" {
+		t.Errorf("expected the statement to carry a query ID, got %v", mock.queryIDs)
+	}
+}
+
+func TestExecuteStatementInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mock := &interruptExecutor{trigger: "sleep", cancel: cancel}
+
+	err := executeStatement(ctx, mock, "SELECT sleep(3)", statementOptions{}, testLogger(&bytes.Buffer{}))
+	if !errors.Is(err, errInterrupted) {
+		t.Fatalf("expected interrupted error, got %v", err)
+	}
+	if len(mock.killedQueries) != 1 || mock.killedQueries[0] != mock.queryIDs[0] {
+		t.Errorf("expected KILL QUERY for %v, got %v", mock.queryIDs, mock.killedQueries)
+	}
+
+	// Nothing new starts once the context is cancelled
+	if err := executeStatement(ctx, mock, "SELECT 1", statementOptions{}, testLogger(&bytes.Buffer{})); !errors.Is(err, errInterrupted) {
+		t.Errorf("expected interrupted error before executing, got %v", err)
+	}
+	if len(mock.queryIDs) != 1 {
+		t.Errorf("expected no further statements, got %v", mock.queryIDs)
+	}
+}
+
+func TestExecuteStatementTimeoutKillsQuery(t *testing.T) {
+	mock := &contextExecutor{block: true}
+
+	err := executeStatement(ctxbg, mock, "SELECT sleep(3)", statementOptions{timeout: 10 * time.Millisecond}, testLogger(&bytes.Buffer{}))
+	if err == nil || !strings.Contains(err.Error(), "exceeded the 10ms timeout") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if len(mock.killedQueries) != 1 {
+		t.Errorf("expected the timed out query to be killed, got %v", mock.killedQueries)
+	}
+}
+
+func TestExecuteSQLWithWriterDeterministicQueryIDs(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "002_users.sql", "SELECT 1;\nSELECT 2;\n")
+	info := MigrationInfo{Version: "2.0.5", Filename: "002_users.sql", Path: path}
+	mock := &interruptExecutor{}
+	ctx := withRunID(ctxbg, "run1")
+
+	if _, err := executeSQLWithWriter(ctx, mock, info, sqlSource{}, retryPolicy{}, testLogger(&bytes.Buffer{})); err != nil {
+		t.Fatalf("executeSQLWithWriter failed: %v", err)
+	}
+	want := []string{"run1-2.0.5-1", "run1-2.0.5-2"}
+	if strings.Join(mock.queryIDs, ",") != strings.Join(want, ",") {
+		t.Errorf("expected query IDs %v, got %v", want, mock.queryIDs)
+	}
+}
+
+func TestExecuteStatementLogComment(t *testing.T) {
+	mock := &contextExecutor{}
+	comment := logComment{RunID: "run1", File: "002_users.sql", Version: "2.0.5", Statement: 3}.String()
+
+	opts := statementOptions{settings: map[string]string{"mutations_sync": "2"}, logComment: comment}
+	if err := executeStatement(ctxbg, mock, "SELECT 1", opts, testLogger(&bytes.Buffer{})); err != nil {
+		t.Fatalf("executeStatement failed: %v", err)
+	}
+	want := `{"tool":"dbmigrate","run_id":"run1","file":"002_users.sql","version":"2.0.5","statement":3}`
+	if got := mock.settings[0]["log_comment"]; got != want {
+		t.Errorf("expected log_comment %s, got %s", want, got)
+	}
+	if mock.settings[0]["mutations_sync"] != "2" || len(opts.settings) != 1 {
+		t.Errorf("expected file settings kept and not modified, got %v / %v", mock.settings[0], opts.settings)
+	}
+
+	// A log_comment set with -- setting: wins
+	opts.settings = map[string]string{"log_comment": "backfill"}
+	if err := executeStatement(ctxbg, mock, "SELECT 1", opts, testLogger(&bytes.Buffer{})); err != nil {
+		t.Fatalf("executeStatement failed: %v", err)
+	}
+	if got := mock.settings[1]["log_comment"]; got != "backfill" {
+		t.Errorf("expected the file's log_comment, got %s", got)
+	}
+}
+
+func TestExecuteStatementErrorIncludesQueryID(t *testing.T) {
+	mock := &flakyExecutor{failures: 10, err: &clickhouse.Exception{Code: 252}}
+	opts := statementOptions{retry: fastRetries, queryID: "run1-2.0.5-1"}
+
+	err := executeStatement(ctxbg, mock, "SELECT 1", opts, testLogger(&bytes.Buffer{}))
+	if err == nil || !strings.Contains(err.Error(), "(query_id run1-2.0.5-1-retry3)") {
+		t.Errorf("expected the last attempt's query ID in the error, got %v", err)
+	}
+}
+
+// ============================================================================
+// Tests for interrupting run
+// ============================================================================
+
+func TestRunInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	writeTestFile(t, dir, "002.sql", "-- version: 1.0.1\nINSERT INTO a SELECT number FROM numbers(1e10);\n")
+	writeTestFile(t, dir, "003.sql", "-- version: 1.0.2\nCREATE TABLE c (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n002.sql\n003.sql\n")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mock := &interruptExecutor{trigger: "numbers(1e10)", cancel: cancel}
+
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath},
+		Executor: mock,
+		Context:  ctx,
+	}
+
+	if exitCode := run(cfg); exitCode != exitInterrupted {
+		t.Fatalf("expected exit code %d, got %d: %s", exitInterrupted, exitCode, stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "002.sql: statement 1 interrupted") {
+		t.Errorf("expected interrupted error, got %q", stderr.String())
+	}
+	if len(mock.killedQueries) != 1 {
+		t.Errorf("expected one KILL QUERY, got %v", mock.killedQueries)
+	}
+
+	executed := strings.Join(mock.executedSQL, "\n")
+	if !strings.Contains(executed, "'1.0.1'") || !strings.Contains(executed, "'interrupted'") {
+		t.Errorf("expected 1.0.1 to be recorded as interrupted, got %s", executed)
+	}
+	if strings.Contains(executed, "CREATE TABLE c") {
+		t.Errorf("expected no migrations after the interrupt, got %s", executed)
+	}
+}
+
+func TestBuildMigrationStatusInterrupted(t *testing.T) {
+	migrations := []MigrationInfo{{Version: "1.0.0", Checksum: "aaa"}}
+	records := []MigrationRecord{{Version: "1.0.0", Checksum: "aaa", Status: statusInterrupted}}
+
+	statuses := buildMigrationStatus(migrations, records, nil)
+	if statuses[0].State != stateInterrupted {
+		t.Errorf("expected interrupted state, got %s", statuses[0].State)
+	}
+	if !statusNeedsAction(statuses) {
+		t.Error("interrupted migrations should need action")
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+// defaultNullValue is the text that stands for NULL in data files, as in ClickHouse's own CSV and TSV output
+const defaultNullValue = `\N`
+
+// tableColumn is a column of a table as listed by DESCRIBE TABLE
+type tableColumn struct {
+	Name        string
+	Type        string
+	DefaultKind string // DEFAULT, MATERIALIZED, ALIAS, EPHEMERAL or empty
+}
+
+// describeTable returns the columns of table
+func describeTable(ctx context.Context, executor DatabaseExecutor, table string) ([]tableColumn, error) {
+	rows, err := executor.Query(ctx, "DESCRIBE TABLE "+table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe table %s: %w", table, err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("failed to describe table %s: no columns returned", table)
+	}
+
+	columns := make([]tableColumn, 0, len(rows))
+	for _, row := range rows {
+		var c tableColumn
+		c.Name, _ = row["name"].(string)
+		c.Type, _ = row["type"].(string)
+		c.DefaultKind, _ = row["default_type"].(string)
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// valueConverter converts the text of a field to a value the driver accepts for its column
+type valueConverter func(s string) (any, error)
+
+// columnConverter converts the fields of one column of a data file
+type columnConverter struct {
+	convert     valueConverter
+	nullable    bool
+	emptyIsNull bool // Empty fields are NULL in Nullable columns
+}
+
+// value converts a field. NULL is an error in columns that are not Nullable.
+func (c columnConverter) value(field string, null bool) (any, error) {
+	if null || (field == "" && c.emptyIsNull && c.nullable) {
+		if !c.nullable {
+			return nil, fmt.Errorf("NULL in a column that is not Nullable")
+		}
+		return nil, nil
+	}
+	return c.convert(field)
+}
+
+// columnConverters returns a converter for each column of a data file, from the
+// columns of its table. With emptyIsNull, as for CSV and TSV files, empty fields are
+// NULL in Nullable columns.
+func columnConverters(headers []string, columns []tableColumn, table string, emptyIsNull bool) ([]columnConverter, error) {
+	byName := make(map[string]tableColumn, len(columns))
+	for _, c := range columns {
+		byName[c.Name] = c
+	}
+
+	converters := make([]columnConverter, len(headers))
+	for i, name := range headers {
+		column, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("column %s does not exist in table %s", name, table)
+		}
+		if column.DefaultKind == "MATERIALIZED" || column.DefaultKind == "ALIAS" {
+			return nil, fmt.Errorf("column %s is %s and cannot be loaded", name, column.DefaultKind)
+		}
+		convert, err := typeConverter(column.Type)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", name, err)
+		}
+		converters[i] = columnConverter{convert: convert, nullable: isNullableType(column.Type), emptyIsNull: emptyIsNull}
+	}
+	return converters, nil
+}
+
+// isNullableType reports whether a ClickHouse type is Nullable, also inside LowCardinality
+func isNullableType(chType string) bool {
+	if inner, ok := typeArgs(chType, "LowCardinality"); ok {
+		chType = inner
+	}
+	_, ok := typeArgs(chType, "Nullable")
+	return ok
+}
+
+// typeConverter returns the converter for values of a ClickHouse type. Nullable
+// types convert non-NULL values; callers decide what stands for NULL.
+// Types without a converter of their own, such as Map or JSON, are passed as text.
+func typeConverter(chType string) (valueConverter, error) {
+	chType = strings.TrimSpace(chType)
+	name, _, _ := strings.Cut(chType, "(")
+
+	switch name {
+	case "LowCardinality", "Nullable":
+		inner, _ := typeArgs(chType, name)
+		return typeConverter(inner)
+	case "Array":
+		inner, _ := typeArgs(chType, name)
+		return arrayConverter(inner)
+	case "Int8", "Int16", "Int32", "Int64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(name, "Int"))
+		return func(s string) (any, error) {
+			v, err := strconv.ParseInt(strings.TrimSpace(s), 10, bits)
+			if err != nil {
+				return nil, invalidValue(s, name)
+			}
+			switch bits {
+			case 8:
+				return int8(v), nil
+			case 16:
+				return int16(v), nil
+			case 32:
+				return int32(v), nil
+			}
+			return v, nil
+		}, nil
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(name, "UInt"))
+		return func(s string) (any, error) {
+			v, err := strconv.ParseUint(strings.TrimSpace(s), 10, bits)
+			if err != nil {
+				return nil, invalidValue(s, name)
+			}
+			switch bits {
+			case 8:
+				return uint8(v), nil
+			case 16:
+				return uint16(v), nil
+			case 32:
+				return uint32(v), nil
+			}
+			return v, nil
+		}, nil
+	case "Int128", "Int256", "UInt128", "UInt256":
+		signed := strings.HasPrefix(name, "Int")
+		bits, _ := strconv.Atoi(strings.TrimPrefix(strings.TrimPrefix(name, "U"), "Int"))
+		// The range is [-2^(bits-1), 2^(bits-1)-1] signed and [0, 2^bits-1] unsigned
+		lowest, highest := new(big.Int), new(big.Int).Lsh(big.NewInt(1), uint(bits))
+		if signed {
+			highest.Rsh(highest, 1)
+			lowest.Neg(highest)
+		}
+		highest.Sub(highest, big.NewInt(1))
+		return func(s string) (any, error) {
+			v, ok := new(big.Int).SetString(strings.TrimSpace(s), 10)
+			if !ok || (!signed && v.Sign() < 0) {
+				return nil, invalidValue(s, name)
+			}
+			if v.Cmp(lowest) < 0 || v.Cmp(highest) > 0 {
+				return nil, fmt.Errorf("%q is out of range for %s", s, name)
+			}
+			return v, nil
+		}, nil
+	case "Float32":
+		return func(s string) (any, error) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 32)
+			if err != nil {
+				return nil, invalidValue(s, name)
+			}
+			return float32(v), nil
+		}, nil
+	case "Float64":
+		return func(s string) (any, error) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				return nil, invalidValue(s, name)
+			}
+			return v, nil
+		}, nil
+	case "Bool":
+		return func(s string) (any, error) {
+			v, err := strconv.ParseBool(strings.TrimSpace(s))
+			if err != nil {
+				return nil, invalidValue(s, name)
+			}
+			return v, nil
+		}, nil
+	case "String":
+		return func(s string) (any, error) { return s, nil }, nil
+	case "FixedString":
+		args, _ := typeArgs(chType, name)
+		size, err := strconv.Atoi(strings.TrimSpace(args))
+		if err != nil {
+			return nil, fmt.Errorf("unsupported type %s", chType)
+		}
+		return func(s string) (any, error) {
+			if len(s) > size {
+				return nil, fmt.Errorf("%q is longer than %d bytes", s, size)
+			}
+			return s, nil
+		}, nil
+	case "Date", "Date32":
+		return func(s string) (any, error) {
+			v, err := time.ParseInLocation("2006-01-02", strings.TrimSpace(s), time.UTC)
+			if err != nil {
+				return nil, invalidValue(s, name)
+			}
+			return v, nil
+		}, nil
+	case "DateTime", "DateTime64":
+		loc, err := typeLocation(chType, name)
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) (any, error) {
+			v, ok := parseDateTime(strings.TrimSpace(s), loc)
+			if !ok {
+				return nil, invalidValue(s, name)
+			}
+			return v, nil
+		}, nil
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		scale, err := decimalScale(chType, name)
+		if err != nil {
+			return nil, err
+		}
+		return func(s string) (any, error) {
+			v, err := decimal.NewFromString(strings.TrimSpace(s))
+			if err != nil {
+				return nil, invalidValue(s, chType)
+			}
+			if -v.Exponent() > scale && !v.Equal(v.Truncate(scale)) {
+				return nil, fmt.Errorf("%q has more than %d decimal places", s, scale)
+			}
+			return v, nil
+		}, nil
+	case "UUID":
+		return func(s string) (any, error) {
+			v, err := uuid.Parse(strings.TrimSpace(s))
+			if err != nil {
+				return nil, invalidValue(s, name)
+			}
+			return v, nil
+		}, nil
+	case "IPv4", "IPv6":
+		return func(s string) (any, error) {
+			v, err := netip.ParseAddr(strings.TrimSpace(s))
+			if err != nil || (name == "IPv4" && !v.Is4()) {
+				return nil, invalidValue(s, name)
+			}
+			return v, nil
+		}, nil
+	case "Enum8", "Enum16":
+		args, _ := typeArgs(chType, name)
+		names, err := enumNames(args)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported type %s", chType)
+		}
+		return func(s string) (any, error) {
+			if !names[s] {
+				return nil, invalidValue(s, chType)
+			}
+			return s, nil
+		}, nil
+	}
+	return func(s string) (any, error) { return s, nil }, nil
+}
+
+// arrayConverter returns the converter for Array(elemType) values written as
+// literals such as [1,2,3] or ['a','b']. An empty field is an empty array.
+func arrayConverter(elemType string) (valueConverter, error) {
+	convert, err := typeConverter(elemType)
+	if err != nil {
+		return nil, err
+	}
+	nullable := isNullableType(elemType)
+
+	return func(s string) (any, error) {
+		elements, err := splitArrayLiteral(s)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]any, len(elements))
+		for i, e := range elements {
+			if e.null {
+				if !nullable {
+					return nil, fmt.Errorf("NULL element in an array of %s", elemType)
+				}
+				continue
+			}
+			if values[i], err = convert(e.text); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}, nil
+}
+
+// arrayElement is an element of an array literal
+type arrayElement struct {
+	text string // Unquoted text
+	null bool   // The element is an unquoted NULL
+}
+
+// splitArrayLiteral splits an array literal into its elements. Quoted elements are
+// unquoted; nested arrays and tuples are kept whole.
+func splitArrayLiteral(s string) ([]arrayElement, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("%q is not an array literal", s)
+	}
+
+	parts, err := splitTopLevel(s[1:len(s)-1], ',')
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an array literal: %w", s, err)
+	}
+	elements := make([]arrayElement, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		switch {
+		case part == "" && len(parts) == 1:
+			return nil, nil // []
+		case part == "NULL":
+			elements = append(elements, arrayElement{null: true})
+		case strings.HasPrefix(part, "'") || strings.HasPrefix(part, `"`):
+			text, err := unquoteLiteral(part)
+			if err != nil {
+				return nil, fmt.Errorf("%q is not an array literal: %w", s, err)
+			}
+			elements = append(elements, arrayElement{text: text})
+		default:
+			elements = append(elements, arrayElement{text: part})
+		}
+	}
+	return elements, nil
+}
+
+// splitTopLevel splits s at sep, except inside quotes, brackets and parentheses
+func splitTopLevel(s string, sep byte) ([]string, error) {
+	var parts []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced %c", c)
+			}
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced brackets")
+	}
+	return append(parts, s[start:]), nil
+}
+
+// unquoteLiteral returns the value of a quoted ClickHouse string literal. Both
+// backslash escapes and doubled quotes are accepted.
+func unquoteLiteral(s string) (string, error) {
+	if len(s) < 2 || s[len(s)-1] != s[0] {
+		return "", fmt.Errorf("unterminated quote in %s", s)
+	}
+	quote := s[0]
+	body := s[1 : len(s)-1]
+
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\\' && i+1 < len(body):
+			i++
+			switch body[i] {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '0':
+				b.WriteByte(0)
+			default:
+				b.WriteByte(body[i])
+			}
+		case c == quote && i+1 < len(body) && body[i+1] == quote:
+			b.WriteByte(quote)
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String(), nil
+}
+
+// enumNames returns the names of an Enum8 or Enum16 type from its arguments, e.g. 'a' = 1, 'b' = 2
+func enumNames(args string) (map[string]bool, error) {
+	parts, err := splitTopLevel(args, ',')
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(parts))
+	for _, part := range parts {
+		i := strings.LastIndex(part, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid enum value %s", part)
+		}
+		name, err := unquoteLiteral(strings.TrimSpace(part[:i]))
+		if err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, nil
+}
+
+// typeArgs returns the arguments of a parametric type such as Nullable(Int32), if chType is one named name
+func typeArgs(chType, name string) (string, bool) {
+	inner, ok := strings.CutPrefix(strings.TrimSpace(chType), name+"(")
+	if !ok || !strings.HasSuffix(inner, ")") {
+		return "", false
+	}
+	return inner[:len(inner)-1], true
+}
+
+// decimalScale returns the scale of a Decimal(P, S) or DecimalN(S) type
+func decimalScale(chType, name string) (int32, error) {
+	args, _ := typeArgs(chType, name)
+	parts := strings.Split(args, ",")
+	scale, err := strconv.ParseInt(strings.TrimSpace(parts[len(parts)-1]), 10, 32)
+	if err != nil || (name == "Decimal" && len(parts) != 2) {
+		return 0, fmt.Errorf("unsupported type %s", chType)
+	}
+	return int32(scale), nil
+}
+
+// typeLocation returns the time zone of a DateTime('tz') or DateTime64(p, 'tz') type, or UTC
+func typeLocation(chType, name string) (*time.Location, error) {
+	args, ok := typeArgs(chType, name)
+	if !ok {
+		return time.UTC, nil
+	}
+	parts, err := splitTopLevel(args, ',')
+	if err != nil {
+		return nil, fmt.Errorf("unsupported type %s", chType)
+	}
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "'") {
+			continue
+		}
+		zone, err := unquoteLiteral(part)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported type %s", chType)
+		}
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone in %s: %w", chType, err)
+		}
+		return loc, nil
+	}
+	return time.UTC, nil
+}
+
+// dateTimeLayouts are the text forms accepted for DateTime and DateTime64 values.
+// Times without an offset are in the column's time zone.
+var dateTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02",
+}
+
+// parseDateTime parses a DateTime or DateTime64 value: one of dateTimeLayouts, or
+// Unix seconds with an optional fraction
+func parseDateTime(s string, loc *time.Location) (time.Time, bool) {
+	if sec, frac, isNumber := strings.Cut(s, "."); sec != "" && allDigits(sec) && (!isNumber || (frac != "" && allDigits(frac))) {
+		seconds, err := strconv.ParseInt(sec, 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		var nanos int64
+		if frac != "" {
+			frac = (frac + "000000000")[:9]
+			nanos, _ = strconv.ParseInt(frac, 10, 64)
+		}
+		return time.Unix(seconds, nanos).In(loc), true
+	}
+
+	for _, layout := range dateTimeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// allDigits reports whether s consists of ASCII digits only
+func allDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// invalidValue is the error for text that is not a value of chType
+func invalidValue(s, chType string) error {
+	return fmt.Errorf("%q is not a valid %s", s, chType)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"math/big"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/shopspring/decimal"
+)
+
+func TestTypeConverter(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("time zone data not available: %v", err)
+	}
+
+	tests := []struct {
+		value  string
+		chType string
+		want   any
+	}{
+		{"42", "UInt64", uint64(42)},
+		{"200", "UInt8", uint8(200)},
+		{"-7", "Nullable(Int32)", int32(-7)},
+		{" 12 ", "Int16", int16(12)},
+		{"170141183460469231731687303715884105727", "Int128", mustBigInt("170141183460469231731687303715884105727")},
+		{"-170141183460469231731687303715884105728", "Int128", mustBigInt("-170141183460469231731687303715884105728")},
+		{"340282366920938463463374607431768211455", "UInt128", mustBigInt("340282366920938463463374607431768211455")},
+		{"1.5", "Float32", float32(1.5)},
+		{"2.25", "Float64", 2.25},
+		{"true", "Bool", true},
+		{"abc", "LowCardinality(String)", "abc"},
+		{"ab", "FixedString(2)", "ab"},
+		{"2026-10-18", "Date", time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)},
+		{"2026-10-18 14:30:00", "DateTime", time.Date(2026, 10, 18, 14, 30, 0, 0, time.UTC)},
+		{"2026-10-18 14:30:00", "DateTime('Europe/Berlin')", time.Date(2026, 10, 18, 14, 30, 0, 0, berlin)},
+		{"2026-10-18T14:30:00.123Z", "DateTime64(3)", time.Date(2026, 10, 18, 14, 30, 0, 123000000, time.UTC)},
+		{"2026-10-18 14:30:00.5", "DateTime64(3, 'Europe/Berlin')", time.Date(2026, 10, 18, 14, 30, 0, 500000000, berlin)},
+		{"1760797800.25", "DateTime64(3)", time.Unix(1760797800, 250000000).UTC()},
+		{"12.50", "Decimal(10, 2)", decimal.RequireFromString("12.50")},
+		{"3.1", "Decimal64(4)", decimal.RequireFromString("3.1")},
+		{"8a7c3b4e-9d2f-4f41-a2d4-3c5e6f708192", "UUID", uuid.MustParse("8a7c3b4e-9d2f-4f41-a2d4-3c5e6f708192")},
+		{"10.0.0.1", "IPv4", netip.MustParseAddr("10.0.0.1")},
+		{"::1", "IPv6", netip.MustParseAddr("::1")},
+		{"b", "Enum8('a' = 1, 'b' = 2)", "b"},
+		{"[1, 2, 3]", "Array(UInt16)", []any{uint16(1), uint16(2), uint16(3)}},
+		{"['a,b', 'it''s', \"q\"]", "Array(String)", []any{"a,b", "it's", "q"}},
+		{"[1, NULL]", "Array(Nullable(Int64))", []any{int64(1), nil}},
+		{"[[1], [2, 3]]", "Array(Array(Int8))", []any{[]any{int8(1)}, []any{int8(2), int8(3)}}},
+		{"[]", "Array(String)", []any{}},
+		{"", "Array(String)", []any{}},
+		{"{'a':1}", "Map(String, UInt8)", "{'a':1}"},
+	}
+	for _, tt := range tests {
+		convert, err := typeConverter(tt.chType)
+		if err != nil {
+			t.Errorf("typeConverter(%s) failed: %v", tt.chType, err)
+			continue
+		}
+		got, err := convert(tt.value)
+		if err != nil {
+			t.Errorf("converting %q to %s failed: %v", tt.value, tt.chType, err)
+			continue
+		}
+		if !convertedEqual(got, tt.want) {
+			t.Errorf("converting %q to %s = %#v, want %#v", tt.value, tt.chType, got, tt.want)
+		}
+	}
+}
+
+func TestTypeConverterInvalid(t *testing.T) {
+	tests := []struct {
+		value  string
+		chType string
+		errMsg string
+	}{
+		{"300", "UInt8", `"300" is not a valid UInt8`},
+		{"", "Int64", `"" is not a valid Int64`},
+		{"-1", "UInt128", `"-1" is not a valid UInt128`},
+		{"170141183460469231731687303715884105728", "Int128", `"170141183460469231731687303715884105728" is out of range for Int128`},
+		{"-170141183460469231731687303715884105729", "Int128", `"-170141183460469231731687303715884105729" is out of range for Int128`},
+		{"340282366920938463463374607431768211456", "UInt128", `"340282366920938463463374607431768211456" is out of range for UInt128`},
+		{"yes please", "Bool", `"yes please" is not a valid Bool`},
+		{"abc", "FixedString(2)", `"abc" is longer than 2 bytes`},
+		{"18/10/2026", "Date", `"18/10/2026" is not a valid Date`},
+		{"12,50", "Decimal(10, 2)", `"12,50" is not a valid Decimal(10, 2)`},
+		{"1.125", "Decimal(10, 2)", `"1.125" has more than 2 decimal places`},
+		{"::1", "IPv4", `"::1" is not a valid IPv4`},
+		{"c", "Enum8('a' = 1, 'b' = 2)", `"c" is not a valid Enum8('a' = 1, 'b' = 2)`},
+		{"[1, x]", "Array(Int32)", `"x" is not a valid Int32`},
+		{"[1, NULL]", "Array(Int32)", "NULL element in an array of Int32"},
+		{"1,2", "Array(Int32)", `"1,2" is not an array literal`},
+		{"['a]", "Array(String)", "unterminated quote"},
+	}
+	for _, tt := range tests {
+		convert, err := typeConverter(tt.chType)
+		if err != nil {
+			t.Errorf("typeConverter(%s) failed: %v", tt.chType, err)
+			continue
+		}
+		_, err = convert(tt.value)
+		if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("converting %q to %s: expected error containing %q, got %v", tt.value, tt.chType, tt.errMsg, err)
+		}
+	}
+}
+
+func TestColumnConverters(t *testing.T) {
+	columns := []tableColumn{
+		{Name: "id", Type: "UInt64"},
+		{Name: "note", Type: "Nullable(String)"},
+		{Name: "score", Type: "LowCardinality(Nullable(String))"},
+		{Name: "total", Type: "UInt64", DefaultKind: "MATERIALIZED"},
+	}
+
+	converters, err := columnConverters([]string{"id", "note", "score"}, columns, "events", true)
+	if err != nil {
+		t.Fatalf("columnConverters failed: %v", err)
+	}
+	for _, c := range converters[1:] {
+		if v, err := c.value("", true); err != nil || v != nil {
+			t.Errorf("expected NULL in a Nullable column, got %#v, %v", v, err)
+		}
+		if v, err := c.value("", false); err != nil || v != nil {
+			t.Errorf("expected an empty field to be NULL in a Nullable column, got %#v, %v", v, err)
+		}
+	}
+	if _, err := converters[0].value("", true); err == nil || !strings.Contains(err.Error(), "not Nullable") {
+		t.Errorf("expected NULL in a non-Nullable column to fail, got %v", err)
+	}
+	if v, err := converters[0].value("7", false); err != nil || v != uint64(7) {
+		t.Errorf("expected 7, got %#v, %v", v, err)
+	}
+
+	// Empty JSON strings are not NULL
+	converters, err = columnConverters([]string{"note"}, columns, "events", false)
+	if err != nil {
+		t.Fatalf("columnConverters failed: %v", err)
+	}
+	if v, err := converters[0].value("", false); err != nil || v != "" {
+		t.Errorf("expected an empty string, got %#v, %v", v, err)
+	}
+
+	if _, err := columnConverters([]string{"id", "missing"}, columns, "events", true); err == nil ||
+		!strings.Contains(err.Error(), "column missing does not exist in table events") {
+		t.Errorf("expected an unknown column error, got %v", err)
+	}
+	if _, err := columnConverters([]string{"total"}, columns, "events", true); err == nil ||
+		!strings.Contains(err.Error(), "MATERIALIZED") {
+		t.Errorf("expected a MATERIALIZED column error, got %v", err)
+	}
+}
+
+func mustBigInt(s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 10)
+	if !ok {
+		panic("invalid big.Int " + s)
+	}
+	return v
+}
+
+// convertedEqual compares converted values, using the Equal methods of times, decimals and big integers
+func convertedEqual(got, want any) bool {
+	switch w := want.(type) {
+	case time.Time:
+		g, ok := got.(time.Time)
+		return ok && g.Equal(w) && g.Location().String() == w.Location().String()
+	case decimal.Decimal:
+		g, ok := got.(decimal.Decimal)
+		return ok && g.Equal(w)
+	case *big.Int:
+		g, ok := got.(*big.Int)
+		return ok && g.Cmp(w) == 0
+	case []any:
+		g, ok := got.([]any)
+		if !ok || len(g) != len(w) {
+			return false
+		}
+		for i := range w {
+			if !convertedEqual(g[i], w[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(got, want)
+}
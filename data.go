@@ -0,0 +1,511 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// defaultBatchSize is the number of rows sent per native INSERT when loading data files
+const defaultBatchSize = 10000
+
+// maxOpenBatches is the number of batches of one data file kept open at once. Each
+// holds a pooled connection until it is sent, and the pool has 12 by default.
+const maxOpenBatches = 4
+
+// dataLoadOptions controls how -data files are loaded
+type dataLoadOptions struct {
+	batchSize int          // Rows per INSERT; 0 = defaultBatchSize
+	nullValue string       // Field text that stands for NULL
+	mode      string       // What to do with changed files: dataModeError (default), dataModeTruncate or dataModeReplace
+	index     indexContext // For @if in data.lst; its Env selects the @<env> folder
+}
+
+// dataListFile is the optional file of a data directory listing the files to load, in order
+const dataListFile = "data.lst"
+
+// dataEnvPrefix starts the names of per-environment data folders, e.g. @dev
+const dataEnvPrefix = "@"
+
+// LoadedFile describes a data file loaded by loadDataWithWriter
+type LoadedFile struct {
+	File    string
+	Table   string
+	Rows    int
+	Skipped bool   // Unchanged since it was loaded
+	Reload  string // dataModeTruncate or dataModeReplace when a changed file was loaded again
+}
+
+// dataEntry is a data file to load
+type dataEntry struct {
+	Path string       // Path on disk
+	File string       // Path relative to the data directory, e.g. analytics/events.csv
+	Name dataFileName // Its Table includes the database for files in a database folder
+}
+
+// collectDataFiles returns the data files of dataDir in load order. When the
+// directory has a data.lst file, it lists the files, in the index.lst syntax.
+// Otherwise the files directly in dataDir are loaded, then those of each database
+// folder, then those of the @<env> folder for ictx.Env, each in name order.
+func collectDataFiles(dataDir string, ictx indexContext, logger *Logger) ([]dataEntry, error) {
+	var paths []string
+	listPath := filepath.Join(dataDir, dataListFile)
+	if _, err := os.Stat(listPath); err == nil {
+		// Unsupported files are kept so that newDataEntry rejects them
+		isEntry := func(name string) bool { return isDataFile(name) || checkDataFileSupported(name) != nil }
+		if err := processIndex(listPath, &paths, ictx, isEntry, logger); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %w", dataListFile, err)
+	} else {
+		if paths, err = scanDataDir(dataDir, logger); err != nil {
+			return nil, err
+		}
+		if ictx.Env != "" {
+			envDir := filepath.Join(dataDir, dataEnvPrefix+ictx.Env)
+			if info, err := os.Stat(envDir); err == nil && info.IsDir() {
+				envPaths, err := scanDataDir(envDir, logger)
+				if err != nil {
+					return nil, err
+				}
+				paths = append(paths, envPaths...)
+			}
+		}
+	}
+
+	entries := make([]dataEntry, 0, len(paths))
+	for _, path := range paths {
+		entry, err := newDataEntry(dataDir, path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// scanDataDir returns the data files directly in dir and then those in its database
+// folders, in name order. @<env> folders and hidden folders are not database folders.
+func scanDataDir(dir string, logger *Logger) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var files, databases []string
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case entry.IsDir():
+			if !strings.HasPrefix(name, dataEnvPrefix) && !strings.HasPrefix(name, ".") {
+				databases = append(databases, filepath.Join(dir, name))
+			}
+		case isDataFile(name):
+			files = append(files, filepath.Join(dir, name))
+		default:
+			if err := checkDataFileSupported(name); err != nil {
+				return nil, fmt.Errorf("data file %s: %w", filepath.Join(dir, name), err)
+			}
+		}
+	}
+	for _, database := range databases {
+		entries, err := os.ReadDir(database)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read database folder: %w", err)
+		}
+		logger.Verbosef("Including database folder: %v", database)
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if err := checkDataFileSupported(entry.Name()); err != nil {
+				return nil, fmt.Errorf("data file %s: %w", filepath.Join(database, entry.Name()), err)
+			}
+			if isDataFile(entry.Name()) {
+				files = append(files, filepath.Join(database, entry.Name()))
+			}
+		}
+	}
+	return files, nil
+}
+
+// newDataEntry maps a data file to its table: <table>.<ext> is loaded into table of
+// the current database and <database>/<table>.<ext> into database.table, also
+// inside an @<env> folder
+func newDataEntry(dataDir, path string) (dataEntry, error) {
+	rel, err := filepath.Rel(dataDir, path)
+	if err != nil {
+		return dataEntry{}, err
+	}
+	rel = filepath.ToSlash(rel)
+	parts := strings.Split(rel, "/")
+	if parts[0] == ".." {
+		return dataEntry{}, fmt.Errorf("data file %s is outside the data directory", rel)
+	}
+	if len(parts) > 1 && strings.HasPrefix(parts[0], dataEnvPrefix) {
+		parts = parts[1:]
+	}
+
+	if err := checkDataFileSupported(parts[len(parts)-1]); err != nil {
+		return dataEntry{}, fmt.Errorf("data file %s: %w", rel, err)
+	}
+	name, ok := parseDataFileName(parts[len(parts)-1])
+	if !ok {
+		return dataEntry{}, fmt.Errorf("%s is not a data file", rel)
+	}
+	switch len(parts) {
+	case 1:
+	case 2:
+		name.Table = parts[0] + "." + name.Table
+	default:
+		return dataEntry{}, fmt.Errorf("data file %s is nested too deeply; use <database>/<table> or <table>", rel)
+	}
+	return dataEntry{Path: path, File: rel, Name: name}, nil
+}
+
+// isDataFile reports whether a file name is that of a data file
+func isDataFile(name string) bool {
+	_, ok := parseDataFileName(filepath.Base(name))
+	return ok
+}
+
+// loadDataWithWriter loads the data files of a directory into database tables. Each
+// file is named after its table, with the extension of its format (.csv, .tsv,
+// .ndjson or .jsonl) and optionally .gz or .zst, e.g. events.csv.gz; files in a
+// folder named after a database are loaded into that database. See collectDataFiles
+// for the order.
+// Loaded files are recorded in data_versions by checksum: unchanged files are
+// skipped, and changed ones are handled as opts.mode says. With dataModeTruncate,
+// all files of a table with a changed file are loaded again (see rebuildDataTable).
+// Returns the files loaded so far, also when an error stops the load.
+func loadDataWithWriter(ctx context.Context, executor DatabaseExecutor, dataDir string, opts dataLoadOptions, logger *Logger) ([]LoadedFile, error) {
+	files, err := collectDataFiles(dataDir, opts.index, logger)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		printDataSummary(nil, logger)
+		return nil, nil
+	}
+
+	versions, err := openDataVersions(ctx, executor)
+	if err != nil {
+		return nil, err
+	}
+
+	rebuilt := make(map[string][]dataEntry)
+	if opts.mode == dataModeTruncate {
+		if rebuilt, err = tablesToRebuild(files, versions); err != nil {
+			return nil, err
+		}
+	}
+
+	// Process each data file
+	var loadedFiles []LoadedFile
+	for _, file := range files {
+		if group, ok := rebuilt[file.Name.Table]; ok {
+			if file.File != group[0].File {
+				continue // Loaded with the first file of its table
+			}
+			loaded, err := rebuildDataTable(ctx, executor, versions, group, opts, logger)
+			loadedFiles = append(loadedFiles, loaded...)
+			if err != nil {
+				return loadedFiles, err
+			}
+			continue
+		}
+
+		fileCtx, span := startSpan(ctx, "dbmigrate.data_file", attrFile.String(file.File), attrTable.String(file.Name.Table))
+		loaded, err := loadVersionedDataFile(fileCtx, executor, versions, file.Path, file.File, file.Name, opts, logger)
+		span.SetAttributes(attrRows.Int(loaded.Rows))
+		if err != nil {
+			err = fmt.Errorf("failed to load %s: %w", file.File, err)
+			endSpan(span, err)
+			return loadedFiles, err
+		}
+		endSpan(span, nil)
+		loadedFiles = append(loadedFiles, loaded)
+	}
+
+	printDataSummary(loadedFiles, logger)
+	return loadedFiles, nil
+}
+
+// tablesToRebuild returns the files of each table that -data-mode truncate empties
+// because one of its files changed since it was loaded, in load order. All of them
+// are loaded again, as the unchanged ones would otherwise lose their rows.
+func tablesToRebuild(files []dataEntry, versions *dataVersions) (map[string][]dataEntry, error) {
+	changed := make(map[string]bool)
+	for _, file := range files {
+		previous, seen := versions.loaded[file.File]
+		if !seen || changed[file.Name.Table] {
+			continue
+		}
+		checksum, err := fileChecksum(file.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", file.File, err)
+		}
+		if checksum != previous.Checksum {
+			changed[file.Name.Table] = true
+		}
+	}
+
+	rebuilt := make(map[string][]dataEntry)
+	for _, file := range files {
+		if changed[file.Name.Table] {
+			rebuilt[file.Name.Table] = append(rebuilt[file.Name.Table], file)
+		}
+	}
+	return rebuilt, nil
+}
+
+// loadVersionedDataFile loads a data file unless data_versions has it with the same
+// checksum, and records it. file is the name it is recorded under.
+func loadVersionedDataFile(ctx context.Context, executor DatabaseExecutor, versions *dataVersions, path, file string, name dataFileName, opts dataLoadOptions, logger *Logger) (LoadedFile, error) {
+	loaded := LoadedFile{File: file, Table: name.Table}
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		return loaded, err
+	}
+
+	previous, seen := versions.loaded[file]
+	switch {
+	case seen && previous.Checksum == checksum:
+		logger.Verbosef("  Skipping %s, unchanged since it was loaded", file)
+		loaded.Skipped = true
+		return loaded, nil
+	case !seen:
+		loaded.Rows, err = stageDataFile(ctx, executor, path, file, name, opts, "", logger)
+	case opts.mode == dataModeReplace: // Changed files with truncate go through rebuildDataTable
+		loaded.Reload = dataModeReplace
+		loaded.Rows, err = stageDataFile(ctx, executor, path, file, name, opts, dataModeReplace, logger)
+	default:
+		return loaded, fmt.Errorf("file changed since it was loaded (checksum %s, loaded %s); use -data-mode %s or %s to load it again",
+			checksum, previous.Checksum, dataModeTruncate, dataModeReplace)
+	}
+	if err != nil {
+		return loaded, err
+	}
+
+	mode := loaded.Reload
+	if mode == "" {
+		mode = "load"
+	}
+	return loaded, versions.record(ctx, file, name.Table, checksum, loaded.Rows, mode)
+}
+
+// printDataSummary prints the data files loaded and skipped
+func printDataSummary(files []LoadedFile, logger *Logger) {
+	if len(files) == 0 {
+		logger.Infof("%s", logger.paint(colorYellow, "No data files found in data directory"))
+		return
+	}
+
+	var loaded, skipped []LoadedFile
+	totalRows := 0
+	for _, f := range files {
+		if f.Skipped {
+			skipped = append(skipped, f)
+		} else {
+			loaded = append(loaded, f)
+			totalRows += f.Rows
+		}
+	}
+
+	logger.Infof("")
+	if len(loaded) > 0 {
+		logger.Infof("%s", logger.paint(colorGreen, fmt.Sprintf("Loaded %d data file(s):", len(loaded))))
+		for _, f := range loaded {
+			note := ""
+			if f.Reload != "" {
+				note = ", reloaded with " + f.Reload
+			}
+			logger.Infof("  %s %s (%d rows%s)", logger.paint(colorGreen, "✓"), f.File, f.Rows, note)
+		}
+	}
+	if len(skipped) > 0 {
+		logger.Infof("%s", logger.paint(colorDim, fmt.Sprintf("Skipped %d unchanged data file(s):", len(skipped))))
+		for _, f := range skipped {
+			logger.Infof("  %s", logger.paint(colorDim, "- "+f.File))
+		}
+	}
+	logger.Infof("%s (%d total rows)", logger.paint(colorGreen, "✓ Data load complete"), totalRows)
+}
+
+// loadDataFileWithWriter streams a data file into its table with native INSERTs of
+// opts.batchSize rows, so memory use does not grow with the file. Fields are
+// converted to the types DESCRIBE TABLE reports for their columns. file is the path
+// of the file in the data directory, which tags its INSERTs.
+// Returns the number of rows loaded; when an error stops the load, batches sent
+// before it stay in the table.
+func loadDataFileWithWriter(ctx context.Context, executor DatabaseExecutor, path, file string, name dataFileName, opts dataLoadOptions, logger *Logger) (int, error) {
+	reader, err := openDataFile(path, name, opts.nullValue)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	headers := reader.Columns()
+	if len(headers) == 0 {
+		return 0, nil // An empty JSON file
+	}
+	columns, err := describeTable(ctx, executor, name.Table)
+	if err != nil {
+		return 0, err
+	}
+	converters, err := columnConverters(headers, columns, name.Table, name.Format != formatJSONEachRow)
+	if err != nil {
+		return 0, err
+	}
+
+	batchSize := opts.batchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+
+	// Rows normally all go into one batch. JSON rows that leave out keys go into a
+	// batch of the columns they have, so the others get their column defaults. When
+	// maxOpenBatches are open, the oldest is sent before another is started.
+	loaded, started := 0, 0
+	batches := make(map[string]*dataBatch) // Open batches by the columns of their rows
+	var order []string                     // Keys of open batches, oldest first
+	defer func() {
+		for _, batch := range batches {
+			batch.Abort()
+		}
+	}()
+	send := func(key string) error {
+		batch := batches[key]
+		delete(batches, key)
+		order = slices.DeleteFunc(order, func(k string) bool { return k == key })
+		if err := batch.send(ctx, executor, logger); err != nil {
+			return err
+		}
+		loaded += batch.rows
+		return nil
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return loaded, err
+		}
+
+		present := make([]int, 0, len(row.Fields))
+		for i := range row.Fields {
+			if row.Missing == nil || !row.Missing[i] {
+				present = append(present, i)
+			}
+		}
+		key := ""
+		if len(present) < len(headers) {
+			key = fmt.Sprint(present)
+		}
+
+		batch := batches[key]
+		if batch == nil && len(batches) == maxOpenBatches {
+			if err := send(order[0]); err != nil {
+				return loaded, err
+			}
+		}
+		if batch == nil {
+			names := make([]string, len(present))
+			for j, i := range present {
+				names[j] = headers[i]
+			}
+			started++
+			if batch, err = startDataBatch(ctx, executor, file, name.Table, names, started); err != nil {
+				return loaded, err
+			}
+			batches[key] = batch
+			order = append(order, key)
+		}
+
+		values := make([]any, len(present))
+		for j, i := range present {
+			if values[j], err = converters[i].value(row.Fields[i], row.Nulls != nil && row.Nulls[i]); err != nil {
+				return loaded, fmt.Errorf("line %d, column %s: %w", row.Line, headers[i], err)
+			}
+		}
+		if err := batch.Append(values...); err != nil {
+			return loaded, fmt.Errorf("line %d: %w", row.Line, err)
+		}
+		batch.rows++
+
+		if batch.rows == batchSize {
+			if err := send(key); err != nil {
+				return loaded, err
+			}
+		}
+	}
+
+	for len(order) > 0 {
+		if err := send(order[0]); err != nil {
+			return loaded, err
+		}
+	}
+
+	return loaded, nil
+}
+
+// dataBatch is one native INSERT of a data file, tagged with a query ID like a statement
+type dataBatch struct {
+	Batch
+	queryID string
+	table   string
+	rows    int
+}
+
+// startDataBatch prepares the INSERT of batch number n of a data file. Its query ID
+// is derived from the file rather than the table, as several files may fill one table.
+func startDataBatch(ctx context.Context, executor DatabaseExecutor, file, table string, columns []string, n int) (*dataBatch, error) {
+	if ctx.Err() != nil {
+		return nil, errInterrupted
+	}
+
+	opts := statementOptions{
+		queryID:    statementQueryIDFor(ctx, "data", file, strconv.Itoa(n)),
+		logComment: logComment{RunID: contextRunID(ctx), File: file, Table: table}.String(),
+	}
+	if opts.queryID == "" {
+		opts.queryID = newQueryID()
+	}
+	batchCtx := withQueryID(withStatementSettings(ctx, opts.effectiveSettings()), opts.queryID)
+
+	batch, err := executor.PrepareBatch(batchCtx, table, columns)
+	if err != nil {
+		return nil, fmt.Errorf("insert failed (query_id %s): %w", opts.queryID, err)
+	}
+	return &dataBatch{Batch: batch, queryID: opts.queryID, table: table}, nil
+}
+
+// send sends the batch. When the run is interrupted the INSERT is killed, as
+// executeStatement does for statements.
+func (b *dataBatch) send(ctx context.Context, executor DatabaseExecutor, logger *Logger) error {
+	if ctx.Err() != nil {
+		b.Abort()
+		return errInterrupted
+	}
+
+	logger.Verbosef("  Inserting %d rows into %s", b.rows, b.table)
+	logger.Debugf("  Query ID %s", b.queryID)
+	if err := b.Send(); err != nil {
+		if ctx.Err() != nil {
+			killQuery(executor, b.queryID, logger)
+			return errInterrupted
+		}
+		return fmt.Errorf("insert failed (query_id %s): %w", b.queryID, err)
+	}
+	return nil
+}
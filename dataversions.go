@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Values of -data-mode: what to do with data files that changed since they were loaded
+const (
+	dataModeError    = "error"    // Stop the load
+	dataModeTruncate = "truncate" // Empty the table and load the file again
+	dataModeReplace  = "replace"  // Delete the rows whose primary key is in the file, then load it
+)
+
+// createDataVersionsTableSQL creates the table recording loaded data files. A file
+// loaded again replaces its row.
+const createDataVersionsTableSQL = `CREATE TABLE IF NOT EXISTS data_versions (
+    file String,
+    table_name String,
+    checksum String,
+    rows UInt64,
+    mode LowCardinality(String),
+    loaded_at DateTime64(3),
+    run_id String
+) ENGINE = ReplacingMergeTree(loaded_at)
+ORDER BY file`
+
+// dataVersion is a row of the data_versions table
+type dataVersion struct {
+	File     string
+	Table    string
+	Checksum string
+	Rows     int
+	LoadedAt time.Time
+}
+
+// dataVersions records loaded data files in data_versions
+type dataVersions struct {
+	executor DatabaseExecutor
+	loaded   map[string]dataVersion // By file
+}
+
+// openDataVersions creates data_versions if needed and reads the files loaded so far
+func openDataVersions(ctx context.Context, executor DatabaseExecutor) (*dataVersions, error) {
+	if err := executor.Execute(ctx, createDataVersionsTableSQL); err != nil {
+		return nil, fmt.Errorf("failed to create data_versions: %w", err)
+	}
+	rows, err := executor.Query(ctx, "SELECT file, table_name, checksum, rows, loaded_at FROM data_versions FINAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data_versions: %w", err)
+	}
+
+	v := &dataVersions{executor: executor, loaded: make(map[string]dataVersion, len(rows))}
+	for _, row := range rows {
+		var r dataVersion
+		r.File, _ = row["file"].(string)
+		r.Table, _ = row["table_name"].(string)
+		r.Checksum, _ = row["checksum"].(string)
+		r.Rows = int(toInt64(row["rows"]))
+		r.LoadedAt, _ = row["loaded_at"].(time.Time)
+		v.loaded[r.File] = r
+	}
+	return v, nil
+}
+
+// record writes the data_versions row of a loaded file
+func (v *dataVersions) record(ctx context.Context, file, table, checksum string, rows int, mode string) error {
+	sql := fmt.Sprintf(
+		"INSERT INTO data_versions (file, table_name, checksum, rows, mode, loaded_at, run_id) VALUES ('%s', '%s', '%s', %d, '%s', %s, '%s')",
+		escapeSQLString(file),
+		escapeSQLString(table),
+		escapeSQLString(checksum),
+		rows,
+		escapeSQLString(mode),
+		sqlTime(time.Now()),
+		escapeSQLString(contextRunID(ctx)),
+	)
+	if err := v.executor.Execute(ctx, sql); err != nil {
+		return fmt.Errorf("failed to record %s in data_versions: %w", file, err)
+	}
+	v.loaded[file] = dataVersion{File: file, Table: table, Checksum: checksum, Rows: rows}
+	return nil
+}
+
+// forget deletes the data_versions rows of the files recorded for table other than
+// keep, so that they are loaded again
+func (v *dataVersions) forget(ctx context.Context, table string, keep []dataEntry) error {
+	kept := make(map[string]bool, len(keep))
+	for _, file := range keep {
+		kept[file.File] = true
+	}
+	var files []string
+	for file, version := range v.loaded {
+		if version.Table == table && !kept[file] {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	sort.Strings(files)
+
+	quoted := make([]string, len(files))
+	for i, file := range files {
+		quoted[i] = "'" + escapeSQLString(file) + "'"
+	}
+	sql := fmt.Sprintf("DELETE FROM data_versions WHERE file IN (%s)", strings.Join(quoted, ", "))
+	if err := v.executor.Execute(ctx, sql); err != nil {
+		return fmt.Errorf("failed to forget %s in data_versions: %w", strings.Join(files, ", "), err)
+	}
+	for _, file := range files {
+		delete(v.loaded, file)
+	}
+	return nil
+}
+
+// fileChecksum returns the MD5 checksum of a file, hex encoded like migration checksums
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open data file: %w", err)
+	}
+	defer f.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", fmt.Errorf("failed to read data file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// executeDataStatement runs a statement of a data load, tagged with a query ID derived
+// from the file like its batches
+func executeDataStatement(ctx context.Context, executor DatabaseExecutor, file, table, step, sql string, logger *Logger) error {
+	opts := statementOptions{
+		queryID:    statementQueryIDFor(ctx, "data", file, step),
+		logComment: logComment{RunID: contextRunID(ctx), File: file, Table: table}.String(),
+	}
+	logger.Verbosef("  %s", sql)
+	return executeStatement(ctx, executor, sql, opts, logger)
+}
+
+// tablePrimaryKey returns the primary key expression of table, e.g. "id" or "tenant, id"
+func tablePrimaryKey(ctx context.Context, executor DatabaseExecutor, table string) (string, error) {
+	database, name := "currentDatabase()", table
+	if db, t, ok := strings.Cut(table, "."); ok {
+		database, name = "'"+escapeSQLString(db)+"'", t
+	}
+	rows, err := executor.Query(ctx, fmt.Sprintf(
+		"SELECT primary_key FROM system.tables WHERE database = %s AND name = '%s'", database, escapeSQLString(name)))
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the primary key of %s: %w", table, err)
+	}
+	var key string
+	if len(rows) > 0 {
+		key, _ = rows[0]["primary_key"].(string)
+	}
+	if strings.TrimSpace(key) == "" {
+		return "", fmt.Errorf("table %s has no primary key to replace rows by; use -data-mode %s", table, dataModeTruncate)
+	}
+	return key, nil
+}
+
+// stageDataFile loads a file into a staging table and copies the rows over to table
+// only once the whole file is in: a file that fails half way leaves table as it was,
+// so it can simply be loaded again. A changed file reloaded with -data-mode replace
+// first deletes the rows of table whose primary key is in the file; rows with other
+// keys are kept.
+func stageDataFile(ctx context.Context, executor DatabaseExecutor, path, file string, name dataFileName, opts dataLoadOptions, reload string, logger *Logger) (int, error) {
+	rows := 0
+	err := stageData(ctx, executor, file, name.Table, reload, logger, func(stage string) error {
+		staged := name
+		staged.Table = stage
+		var err error
+		rows, err = loadDataFileWithWriter(ctx, executor, path, file, staged, opts, logger)
+		return err
+	})
+	return rows, err
+}
+
+// rebuildDataTable loads every file of a table again, for -data-mode truncate when
+// one of them changed: emptying the table also removes the rows of the unchanged
+// ones. The files are staged together, and the table is emptied and refilled only
+// once all of them are in. Files recorded for the table that are not part of this
+// load, e.g. those of another @<env> folder, are forgotten, so their next load
+// inserts them again.
+func rebuildDataTable(ctx context.Context, executor DatabaseExecutor, versions *dataVersions, files []dataEntry, opts dataLoadOptions, logger *Logger) ([]LoadedFile, error) {
+	table := files[0].Name.Table
+	loaded := make([]LoadedFile, 0, len(files))
+	checksums := make([]string, 0, len(files))
+	err := stageData(ctx, executor, files[0].File, table, dataModeTruncate, logger, func(stage string) error {
+		for _, file := range files {
+			fileCtx, span := startSpan(ctx, "dbmigrate.data_file", attrFile.String(file.File), attrTable.String(table))
+			l := LoadedFile{File: file.File, Table: table, Reload: dataModeTruncate}
+			checksum, err := fileChecksum(file.Path)
+			if err == nil {
+				staged := file.Name
+				staged.Table = stage
+				l.Rows, err = loadDataFileWithWriter(fileCtx, executor, file.Path, file.File, staged, opts, logger)
+			}
+			span.SetAttributes(attrRows.Int(l.Rows))
+			if err != nil {
+				err = fmt.Errorf("failed to load %s: %w", file.File, err)
+				endSpan(span, err)
+				return err
+			}
+			endSpan(span, nil)
+			loaded = append(loaded, l)
+			checksums = append(checksums, checksum)
+		}
+		// Before the table is emptied: should that fail, the rows of these files are
+		// still in it
+		return versions.forget(ctx, table, files)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, l := range loaded {
+		if err := versions.record(ctx, l.File, table, checksums[i], l.Rows, dataModeTruncate); err != nil {
+			return loaded[:i], err
+		}
+	}
+	return loaded, nil
+}
+
+// stageData creates a staging table like table, lets fill load it, and then copies
+// its rows over to table. reload says what happens to the rows of table first: with
+// dataModeTruncate it is emptied, with dataModeReplace the rows whose primary key is
+// staged are deleted. file is the data file the statements are tagged with.
+func stageData(ctx context.Context, executor DatabaseExecutor, file, table, reload string, logger *Logger, fill func(stage string) error) error {
+	var key string
+	if reload == dataModeReplace {
+		var err error
+		if key, err = tablePrimaryKey(ctx, executor, table); err != nil {
+			return err
+		}
+	}
+
+	// A MergeTree rather than a Memory table, so large files are not held in server memory
+	stage := stagingTableName(table, contextRunID(ctx))
+	if err := executeDataStatement(ctx, executor, file, table, "stage",
+		fmt.Sprintf("CREATE TABLE %s AS %s ENGINE = MergeTree ORDER BY tuple()", stage, table), logger); err != nil {
+		return fmt.Errorf("failed to create staging table %s: %w", stage, err)
+	}
+	defer func() {
+		// Dropped even after an interrupt, so it does not outlive the run
+		dropCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), killTimeout)
+		defer cancel()
+		if err := executor.Execute(dropCtx, "DROP TABLE IF EXISTS "+stage); err != nil {
+			logger.Warnf("Could not drop staging table %s: %v", stage, err)
+		}
+	}()
+
+	if err := fill(stage); err != nil {
+		return err
+	}
+
+	type dataStep struct{ step, sql string }
+	var steps []dataStep
+	switch reload {
+	case dataModeTruncate:
+		steps = append(steps, dataStep{"truncate", "TRUNCATE TABLE " + table})
+	case dataModeReplace:
+		steps = append(steps, dataStep{"delete", fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (SELECT %s FROM %s)", table, key, key, stage)})
+	}
+	steps = append(steps, dataStep{"copy", fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", table, stage)})
+	for _, s := range steps {
+		if err := executeDataStatement(ctx, executor, file, table, s.step, s.sql, logger); err != nil {
+			return fmt.Errorf("failed to copy staged rows to %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// stagingTableName returns the name of the table a file for table is staged in
+func stagingTableName(table, runID string) string {
+	if runID == "" {
+		runID = newQueryID()
+	}
+	staged := "dbmigrate_stage_" + strings.ReplaceAll(table, ".", "_") + "_" + strings.ReplaceAll(runID, "-", "")
+	if db, _, ok := strings.Cut(table, "."); ok {
+		staged = db + "." + staged
+	}
+	return staged
+}
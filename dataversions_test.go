@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// dataVersionsExecutor answers the data_versions and system.tables queries of a data load
+type dataVersionsExecutor struct {
+	MockExecutor
+	versions    []map[string]interface{} // Rows of data_versions
+	primaryKeys map[string]string        // By table
+}
+
+func (m *dataVersionsExecutor) Query(ctx context.Context, sql string) ([]map[string]interface{}, error) {
+	switch {
+	case strings.Contains(sql, "FROM data_versions"):
+		return m.versions, nil
+	case strings.Contains(sql, "system.tables"):
+		for table, key := range m.primaryKeys {
+			if strings.Contains(sql, "name = '"+table+"'") {
+				return []map[string]interface{}{{"primary_key": key}}, nil
+			}
+		}
+		return nil, nil
+	}
+	return m.MockExecutor.Query(ctx, sql)
+}
+
+// newDataVersionsExecutor returns an executor for loading users.csv, previously loaded with checksum
+func newDataVersionsExecutor(checksum string) *dataVersionsExecutor {
+	users := []tableColumn{{Name: "id", Type: "UInt32"}, {Name: "name", Type: "String"}}
+	m := &dataVersionsExecutor{primaryKeys: map[string]string{"users": "id"}}
+	m.tables = map[string][]tableColumn{"users": users}
+	if checksum != "" {
+		m.versions = []map[string]interface{}{{"file": "users.csv", "table_name": "users", "checksum": checksum, "rows": uint64(1)}}
+	}
+	return m
+}
+
+// statementsContaining returns the executed statements that contain s
+func statementsContaining(statements []string, s string) []string {
+	var found []string
+	for _, sql := range statements {
+		if strings.Contains(sql, s) {
+			found = append(found, sql)
+		}
+	}
+	return found
+}
+
+func TestLoadDataRecordsNewFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n2,bar\n")
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		t.Fatalf("fileChecksum failed: %v", err)
+	}
+	mock := newDataVersionsExecutor("")
+
+	loaded, err := loadDataWithWriter(withRunID(ctxbg, "run1"), mock, dir, dataLoadOptions{}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Rows != 2 || loaded[0].Skipped {
+		t.Fatalf("expected users.csv loaded, got %+v", loaded)
+	}
+
+	if len(statementsContaining(mock.executedSQL, "CREATE TABLE IF NOT EXISTS data_versions")) != 1 {
+		t.Errorf("expected data_versions to be created, got %v", mock.executedSQL)
+	}
+	records := statementsContaining(mock.executedSQL, "INSERT INTO data_versions")
+	if len(records) != 1 || !strings.Contains(records[0], "'users.csv', 'users', '"+checksum+"', 2, 'load'") ||
+		!strings.Contains(records[0], "'run1')") {
+		t.Errorf("expected users.csv recorded with its checksum, got %v", records)
+	}
+}
+
+func TestLoadDataSkipsUnchangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n")
+	checksum, _ := fileChecksum(path)
+	mock := newDataVersionsExecutor(checksum)
+	var out bytes.Buffer
+
+	loaded, err := loadDataWithWriter(ctxbg, mock, dir, dataLoadOptions{}, testLogger(&out))
+	if err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+	if len(loaded) != 1 || !loaded[0].Skipped {
+		t.Errorf("expected users.csv skipped, got %+v", loaded)
+	}
+	if len(mock.inserts) != 0 || len(statementsContaining(mock.executedSQL, "INSERT INTO data_versions")) != 0 {
+		t.Errorf("expected nothing loaded or recorded, got %d inserts and %v", len(mock.inserts), mock.executedSQL)
+	}
+	if !strings.Contains(out.String(), "Skipped 1 unchanged data file(s)") {
+		t.Errorf("expected the skipped file in the summary, got %q", out.String())
+	}
+
+	report := newDataReport(loaded)
+	if len(report.Files) != 0 || len(report.Skipped) != 1 || report.Skipped[0] != "users.csv" {
+		t.Errorf("expected users.csv reported as skipped, got %+v", report)
+	}
+}
+
+func TestLoadDataChangedFileIsAnError(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n")
+	mock := newDataVersionsExecutor("0123456789abcdef")
+
+	_, err := loadDataWithWriter(ctxbg, mock, dir, dataLoadOptions{mode: dataModeError}, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "failed to load users.csv: file changed since it was loaded") ||
+		!strings.Contains(err.Error(), "-data-mode truncate or replace") {
+		t.Errorf("expected a changed file error, got %v", err)
+	}
+	if len(mock.inserts) != 0 {
+		t.Errorf("expected nothing loaded, got %d inserts", len(mock.inserts))
+	}
+}
+
+func TestLoadDataChangedFileTruncate(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n2,bar\n")
+	mock := newDataVersionsExecutor("0123456789abcdef")
+
+	loaded, err := loadDataWithWriter(withRunID(ctxbg, "run1"), mock, dir, dataLoadOptions{mode: dataModeTruncate}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Reload != dataModeTruncate || loaded[0].Rows != 2 {
+		t.Errorf("expected users.csv reloaded with truncate, got %+v", loaded)
+	}
+	if len(statementsContaining(mock.executedSQL, "TRUNCATE TABLE users")) != 1 {
+		t.Errorf("expected users to be truncated, got %v", mock.executedSQL)
+	}
+	if len(mock.inserts) != 1 || mock.inserts[0].table != "dbmigrate_stage_users_run1" {
+		t.Errorf("expected the file loaded into the staging table, got %+v", mock.inserts)
+	}
+	if copied := statementsContaining(mock.executedSQL, "INSERT INTO users SELECT * FROM dbmigrate_stage_users_run1"); len(copied) != 1 {
+		t.Errorf("expected the staged rows copied to users, got %v", mock.executedSQL)
+	}
+	if records := statementsContaining(mock.executedSQL, "INSERT INTO data_versions"); len(records) != 1 || !strings.Contains(records[0], "'truncate'") {
+		t.Errorf("expected the reload recorded, got %v", records)
+	}
+}
+
+func TestLoadDataTruncateReloadsEveryFileOfTheTable(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n2,bar\n")
+	unchanged := writeTestFile(t, dir, "users.tsv", "id\tname\n3\tbaz\n")
+	checksum, _ := fileChecksum(unchanged)
+	mock := newDataVersionsExecutor("0123456789abcdef")
+	mock.versions = append(mock.versions,
+		map[string]interface{}{"file": "users.tsv", "table_name": "users", "checksum": checksum, "rows": uint64(1)},
+		map[string]interface{}{"file": "@staging/users.csv", "table_name": "users", "checksum": "fedcba9876543210", "rows": uint64(5)})
+
+	loaded, err := loadDataWithWriter(withRunID(ctxbg, "run1"), mock, dir, dataLoadOptions{mode: dataModeTruncate}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+	if len(loaded) != 2 || loaded[0].Rows != 2 || loaded[1].Rows != 1 || loaded[1].Skipped || loaded[1].Reload != dataModeTruncate {
+		t.Errorf("expected both files of users reloaded, got %+v", loaded)
+	}
+
+	expected := []string{
+		"CREATE TABLE dbmigrate_stage_users_run1 AS users ENGINE = MergeTree ORDER BY tuple()",
+		"DELETE FROM data_versions WHERE file IN ('@staging/users.csv')",
+		"TRUNCATE TABLE users",
+		"INSERT INTO users SELECT * FROM dbmigrate_stage_users_run1",
+		"DROP TABLE IF EXISTS dbmigrate_stage_users_run1",
+	}
+	var got []string
+	for _, sql := range mock.executedSQL {
+		if !strings.Contains(sql, "INTO data_versions") && !strings.Contains(sql, "CREATE TABLE IF NOT EXISTS data_versions") {
+			got = append(got, sql)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected statements\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if len(mock.inserts) != 2 || mock.inserts[0].table != "dbmigrate_stage_users_run1" || mock.inserts[1].table != "dbmigrate_stage_users_run1" {
+		t.Errorf("expected both files staged together, got %+v", mock.inserts)
+	}
+	records := statementsContaining(mock.executedSQL, "INSERT INTO data_versions")
+	if len(records) != 2 || !strings.Contains(records[0], "'users.csv'") || !strings.Contains(records[1], "'users.tsv', 'users', '"+checksum+"', 1, 'truncate'") {
+		t.Errorf("expected both files recorded, got %v", records)
+	}
+}
+
+func TestLoadDataTruncateFailureKeepsTheTable(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n")
+	unchanged := writeTestFile(t, dir, "users.tsv", "id\tname\nthree\tbaz\n")
+	checksum, _ := fileChecksum(unchanged)
+	mock := newDataVersionsExecutor("0123456789abcdef")
+	mock.versions = append(mock.versions,
+		map[string]interface{}{"file": "users.tsv", "table_name": "users", "checksum": checksum, "rows": uint64(1)})
+
+	loaded, err := loadDataWithWriter(withRunID(ctxbg, "run1"), mock, dir, dataLoadOptions{mode: dataModeTruncate}, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "failed to load users.tsv") {
+		t.Fatalf("expected users.tsv to fail, got %v", err)
+	}
+	if len(loaded) != 0 {
+		t.Errorf("expected nothing loaded, got %+v", loaded)
+	}
+	if len(statementsContaining(mock.executedSQL, "TRUNCATE")) != 0 || len(statementsContaining(mock.executedSQL, "INSERT INTO")) != 0 {
+		t.Errorf("expected users left as it was and nothing recorded, got %v", mock.executedSQL)
+	}
+}
+
+func TestLoadDataChangedFileReplace(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n2,bar\n")
+	mock := newDataVersionsExecutor("0123456789abcdef")
+
+	loaded, err := loadDataWithWriter(withRunID(ctxbg, "run1"), mock, dir, dataLoadOptions{mode: dataModeReplace}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].Reload != dataModeReplace || loaded[0].Rows != 2 {
+		t.Errorf("expected users.csv reloaded with replace, got %+v", loaded)
+	}
+
+	expected := []string{
+		"CREATE TABLE dbmigrate_stage_users_run1 AS users ENGINE = MergeTree ORDER BY tuple()",
+		"DELETE FROM users WHERE (id) IN (SELECT id FROM dbmigrate_stage_users_run1)",
+		"INSERT INTO users SELECT * FROM dbmigrate_stage_users_run1",
+		"DROP TABLE IF EXISTS dbmigrate_stage_users_run1",
+	}
+	var got []string
+	for _, sql := range mock.executedSQL {
+		if !strings.Contains(sql, "data_versions") {
+			got = append(got, sql)
+		}
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected statements\n%s\ngot\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if len(mock.inserts) != 1 || mock.inserts[0].table != "dbmigrate_stage_users_run1" {
+		t.Errorf("expected the file loaded into the staging table, got %+v", mock.inserts)
+	}
+}
+
+func TestLoadDataFailedFileLeavesTableUntouched(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n2,bar\nthree,baz\n")
+	mock := newDataVersionsExecutor("")
+
+	_, err := loadDataWithWriter(withRunID(ctxbg, "run1"), mock, dir, dataLoadOptions{batchSize: 1}, testLogger(io.Discard))
+	if err == nil {
+		t.Fatal("expected the bad row to fail the load")
+	}
+	if len(mock.inserts) != 2 || mock.inserts[0].table != "dbmigrate_stage_users_run1" {
+		t.Errorf("expected the rows before the error sent to the staging table, got %+v", mock.inserts)
+	}
+	if len(statementsContaining(mock.executedSQL, "INSERT INTO users")) != 0 ||
+		len(statementsContaining(mock.executedSQL, "INSERT INTO data_versions")) != 0 {
+		t.Errorf("expected nothing copied to users or recorded, got %v", mock.executedSQL)
+	}
+	if len(statementsContaining(mock.executedSQL, "DROP TABLE IF EXISTS dbmigrate_stage_users_run1")) != 1 {
+		t.Errorf("expected the staging table dropped, got %v", mock.executedSQL)
+	}
+}
+
+func TestLoadDataReplaceNeedsPrimaryKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id,name\n1,foo\n")
+	mock := newDataVersionsExecutor("0123456789abcdef")
+	mock.primaryKeys = nil
+
+	_, err := loadDataWithWriter(ctxbg, mock, dir, dataLoadOptions{mode: dataModeReplace}, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "table users has no primary key") {
+		t.Errorf("expected a primary key error, got %v", err)
+	}
+	if len(statementsContaining(mock.executedSQL, "dbmigrate_stage")) != 0 {
+		t.Errorf("expected no staging table, got %v", mock.executedSQL)
+	}
+}
+
+func TestRunInvalidDataMode(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+
+	exitCode, report, _ := runJSON(t, &MockExecutor{}, "-path", indexPath, "-data-mode", "append")
+	if exitCode != 1 || !strings.Contains(report.Error, `-data-mode must be "error", "truncate" or "replace"`) {
+		t.Errorf("expected a -data-mode error, got exit code %d and %q", exitCode, report.Error)
+	}
+}
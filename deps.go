@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// parseRequires splits a -- requires: header into the required versions
+func parseRequires(s string) []string {
+	var versions []string
+	for _, version := range strings.Split(s, ",") {
+		if version = strings.TrimSpace(version); version != "" {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// orderMigrations returns the migrations in an order where every migration comes after
+// the versions it requires. Among migrations whose requirements are met, index order is
+// kept, so an index that already respects its dependencies is returned unchanged.
+// A requirement must be listed in the index or already applied; cycles are an error.
+func orderMigrations(migrations []MigrationInfo, applied map[string]string) ([]MigrationInfo, error) {
+	positions := make(map[string][]int)
+	for i, info := range migrations {
+		if info.Version != "" {
+			positions[info.Version] = append(positions[info.Version], i)
+		}
+	}
+
+	// Build the graph: dependents[i] lists migrations waiting for migration i
+	dependents := make([][]int, len(migrations))
+	waiting := make([]int, len(migrations))
+	for i, info := range migrations {
+		for _, required := range info.Requires {
+			deps, listed := positions[required]
+			if !listed {
+				if _, ok := applied[required]; ok {
+					continue
+				}
+				return nil, fmt.Errorf("%s requires version %s, which is neither in the index nor applied", info.Filename, required)
+			}
+			for _, dep := range deps {
+				if dep == i {
+					return nil, fmt.Errorf("%s requires its own version %s", info.Filename, required)
+				}
+				dependents[dep] = append(dependents[dep], i)
+				waiting[i]++
+			}
+		}
+	}
+
+	// Kahn's algorithm, always taking the ready migration that comes first in the index
+	var ready []int
+	for i := range migrations {
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	ordered := make([]MigrationInfo, 0, len(migrations))
+	for len(ready) > 0 {
+		sort.Ints(ready)
+		next := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, migrations[next])
+		for _, dependent := range dependents[next] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if len(ordered) < len(migrations) {
+		var cycle []string
+		for i, info := range migrations {
+			if waiting[i] > 0 {
+				cycle = append(cycle, info.Filename)
+			}
+		}
+		return nil, fmt.Errorf("dependency cycle between %s", strings.Join(cycle, ", "))
+	}
+	return ordered, nil
+}
+
+// unmetRequirement returns the first version required by info that is not in done, or ""
+func unmetRequirement(info MigrationInfo, done map[string]bool) string {
+	for _, required := range info.Requires {
+		if !done[required] {
+			return required
+		}
+	}
+	return ""
+}
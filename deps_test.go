@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// migrationVersions returns the versions of migrations in order
+func migrationVersions(migrations []MigrationInfo) []string {
+	versions := make([]string, 0, len(migrations))
+	for _, info := range migrations {
+		versions = append(versions, info.Version)
+	}
+	return versions
+}
+
+// ============================================================================
+// Tests for orderMigrations
+// ============================================================================
+
+func TestOrderMigrationsKeepsIndexOrder(t *testing.T) {
+	migrations := []MigrationInfo{
+		{Version: "1.0.0"},
+		{Version: "1.0.1", Requires: []string{"1.0.0"}},
+		{Version: "1.0.2"},
+	}
+
+	ordered, err := orderMigrations(migrations, nil)
+	if err != nil {
+		t.Fatalf("orderMigrations failed: %v", err)
+	}
+	if versions := migrationVersions(ordered); !reflect.DeepEqual(versions, []string{"1.0.0", "1.0.1", "1.0.2"}) {
+		t.Errorf("expected index order, got %v", versions)
+	}
+}
+
+func TestOrderMigrationsMovesDependenciesFirst(t *testing.T) {
+	migrations := []MigrationInfo{
+		{Version: "billing/2.0.0", Requires: []string{"auth/1.3.0"}},
+		{Version: "reports/1.0.0"},
+		{Version: "auth/1.2.0"},
+		{Version: "auth/1.3.0", Requires: []string{"auth/1.2.0"}},
+	}
+
+	ordered, err := orderMigrations(migrations, nil)
+	if err != nil {
+		t.Fatalf("orderMigrations failed: %v", err)
+	}
+	expected := []string{"reports/1.0.0", "auth/1.2.0", "auth/1.3.0", "billing/2.0.0"}
+	if versions := migrationVersions(ordered); !reflect.DeepEqual(versions, expected) {
+		t.Errorf("expected %v, got %v", expected, versions)
+	}
+}
+
+func TestOrderMigrationsAppliedRequirement(t *testing.T) {
+	migrations := []MigrationInfo{
+		{Version: "2.0.0", Requires: []string{"1.0.0"}},
+	}
+
+	if _, err := orderMigrations(migrations, map[string]string{"1.0.0": "abc"}); err != nil {
+		t.Errorf("expected applied requirement to be accepted, got %v", err)
+	}
+}
+
+func TestOrderMigrationsErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		migrations []MigrationInfo
+		contains   string
+	}{
+		{
+			"missing",
+			[]MigrationInfo{{Version: "2.0.0", Filename: "b.sql", Requires: []string{"1.9.9"}}},
+			"b.sql requires version 1.9.9, which is neither in the index nor applied",
+		},
+		{
+			"self",
+			[]MigrationInfo{{Version: "2.0.0", Filename: "b.sql", Requires: []string{"2.0.0"}}},
+			"requires its own version",
+		},
+		{
+			"cycle",
+			[]MigrationInfo{
+				{Version: "1.0.0", Filename: "a.sql"},
+				{Version: "1.0.1", Filename: "b.sql", Requires: []string{"1.0.2"}},
+				{Version: "1.0.2", Filename: "c.sql", Requires: []string{"1.0.1"}},
+			},
+			"dependency cycle between b.sql, c.sql",
+		},
+	}
+
+	for _, tt := range tests {
+		_, err := orderMigrations(tt.migrations, nil)
+		if err == nil || !strings.Contains(err.Error(), tt.contains) {
+			t.Errorf("%s: expected error containing %q, got %v", tt.name, tt.contains, err)
+		}
+	}
+}
+
+func TestParseMigrationInfoRequires(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "001.sql", "-- version: 2.1.0\n-- requires: 2.0.5, auth/1.3.0\nSELECT 1;\n")
+
+	info, err := parseMigrationInfo(path)
+	if err != nil {
+		t.Fatalf("parseMigrationInfo failed: %v", err)
+	}
+	if !reflect.DeepEqual(info.Requires, []string{"2.0.5", "auth/1.3.0"}) {
+		t.Errorf("unexpected requires %v", info.Requires)
+	}
+}
+
+// ============================================================================
+// Tests for dependencies in run
+// ============================================================================
+
+func TestRunAppliesInDependencyOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "views.sql", "-- version: app/1.0.0\n-- requires: core/1.0.0\nCREATE VIEW v AS SELECT * FROM t;\n")
+	writeTestFile(t, dir, "core.sql", "-- version: core/1.0.0\nCREATE TABLE t (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "views.sql\ncore.sql\n")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	statements := migrationStatements(mock.executedSQL)
+	if len(statements) != 2 || !strings.Contains(statements[0], "CREATE TABLE t") {
+		t.Errorf("expected core.sql to run first, got %v", statements)
+	}
+}
+
+func TestRunRequirementExcludedByTags(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "fixtures.sql", "-- version: 1.0.0\n-- tags: dev\nCREATE TABLE f (x UInt8);\n")
+	writeTestFile(t, dir, "report.sql", "-- version: 1.0.1\n-- requires: 1.0.0\nCREATE VIEW r AS SELECT * FROM f;\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "fixtures.sql\nreport.sql\n")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-tags", "prod"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "report.sql requires version 1.0.0, which has not been applied") {
+		t.Errorf("expected unmet requirement error, got %q", stderr.String())
+	}
+	if len(migrationStatements(mock.executedSQL)) != 0 {
+		t.Errorf("expected nothing to be executed, got %v", mock.executedSQL)
+	}
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Data file formats, named after the ClickHouse formats they match
+const (
+	formatCSV         = "CSVWithNames"
+	formatTSV         = "TabSeparatedWithNames"
+	formatJSONEachRow = "JSONEachRow"
+)
+
+// dataFormats maps the extensions of data files to their format
+var dataFormats = map[string]string{
+	".csv":    formatCSV,
+	".tsv":    formatTSV,
+	".ndjson": formatJSONEachRow,
+	".jsonl":  formatJSONEachRow,
+}
+
+// unsupportedDataFormats maps the extensions of data files that cannot be loaded yet
+// to their format. They stop the load instead of being ignored, so their tables are
+// not left empty unnoticed.
+var unsupportedDataFormats = map[string]string{
+	".parquet": "Parquet",
+}
+
+// dataCompressions are the extensions of compressed data files, e.g. events.csv.gz
+var dataCompressions = []string{".gz", ".zst"}
+
+// dataFileName is the name of a data file split into its parts
+type dataFileName struct {
+	Table       string
+	Format      string
+	Compression string // ".gz", ".zst" or empty
+}
+
+// parseDataFileName splits a file name such as events.csv.gz into its table,
+// format and compression. ok is false for files that are not data files.
+func parseDataFileName(name string) (dataFileName, bool) {
+	var f dataFileName
+	for _, ext := range dataCompressions {
+		if strings.HasSuffix(name, ext) {
+			f.Compression = ext
+			name = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+	ext := filepath.Ext(name)
+	format, ok := dataFormats[ext]
+	if !ok || ext == name {
+		return dataFileName{}, false
+	}
+	f.Format = format
+	f.Table = strings.TrimSuffix(name, ext)
+	return f, true
+}
+
+// checkDataFileSupported returns an error for a file in a format that cannot be loaded yet
+func checkDataFileSupported(name string) error {
+	for _, ext := range dataCompressions {
+		name = strings.TrimSuffix(name, ext)
+	}
+	if format, ok := unsupportedDataFormats[filepath.Ext(name)]; ok {
+		return fmt.Errorf("%s files are not supported yet; export it as NDJSON or CSV", format)
+	}
+	return nil
+}
+
+// dataRow is a row of a data file
+type dataRow struct {
+	Line    int // Line the row starts on
+	Fields  []string
+	Nulls   []bool // Fields that are NULL; nil when none are
+	Missing []bool // Fields the row leaves out, to be filled with column defaults; nil when none are
+}
+
+// rowReader reads the rows of a data file as text fields
+type rowReader interface {
+	// Columns returns the column names, from the header or the first row.
+	// An empty file has no columns.
+	Columns() []string
+	// Read returns the next row, or io.EOF after the last one
+	Read() (dataRow, error)
+	Close() error
+}
+
+// openDataFile opens a data file for reading, decompressing it if needed. Fields
+// equal to nullValue are NULL in CSV and TSV files.
+func openDataFile(path string, name dataFileName, nullValue string) (rowReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data file: %w", err)
+	}
+	closers := []io.Closer{file}
+	closeAll := func() error {
+		var err error
+		for i := len(closers) - 1; i >= 0; i-- {
+			if closeErr := closers[i].Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+
+	var r io.Reader = file
+	switch name.Compression {
+	case ".gz":
+		gz, err := gzip.NewReader(bufio.NewReader(file))
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to read gzip data file: %w", err)
+		}
+		closers = append(closers, gz)
+		r = gz
+	case ".zst":
+		zr, err := zstd.NewReader(file)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to read zstd data file: %w", err)
+		}
+		closers = append(closers, zstdCloser{zr})
+		r = zr
+	}
+
+	var rows rowReader
+	switch name.Format {
+	case formatCSV:
+		rows, err = newCSVRows(r, nullValue, closeAll)
+	case formatTSV:
+		rows, err = newTSVRows(r, nullValue, closeAll)
+	case formatJSONEachRow:
+		rows, err = newJSONRows(r, closeAll)
+	}
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	return rows, nil
+}
+
+// zstdCloser adapts zstd.Decoder, whose Close returns nothing
+type zstdCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// textNulls marks the fields equal to nullValue
+func textNulls(fields []string, nullValue string) []bool {
+	if nullValue == "" {
+		return nil
+	}
+	var nulls []bool
+	for i, field := range fields {
+		if field == nullValue {
+			if nulls == nil {
+				nulls = make([]bool, len(fields))
+			}
+			nulls[i] = true
+		}
+	}
+	return nulls
+}
+
+// csvRows reads a CSV file whose first line names the columns
+type csvRows struct {
+	reader    *csv.Reader
+	columns   []string
+	nullValue string
+	close     func() error
+}
+
+func newCSVRows(r io.Reader, nullValue string, close func() error) (*csvRows, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.ReuseRecord = true
+	reader.FieldsPerRecord = -1 // Checked in Read with a clearer message
+
+	headers, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV headers: %w", err)
+	}
+	if len(headers) == 0 {
+		return nil, fmt.Errorf("CSV file has no columns")
+	}
+	return &csvRows{
+		reader:    reader,
+		columns:   append([]string(nil), headers...),
+		nullValue: nullValue,
+		close:     close,
+	}, nil
+}
+
+func (r *csvRows) Columns() []string {
+	return r.columns
+}
+
+func (r *csvRows) Read() (dataRow, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return dataRow{}, err
+	}
+	if err != nil {
+		return dataRow{}, fmt.Errorf("error reading CSV: %w", err)
+	}
+	line, _ := r.reader.FieldPos(0)
+	if len(record) != len(r.columns) {
+		return dataRow{}, fmt.Errorf("line %d has %d columns, expected %d", line, len(record), len(r.columns))
+	}
+	return dataRow{Line: line, Fields: record, Nulls: textNulls(record, r.nullValue)}, nil
+}
+
+func (r *csvRows) Close() error {
+	return r.close()
+}
+
+// tsvRows reads a TSV file whose first line names the columns. Fields use the
+// escapes of ClickHouse's TabSeparated format, such as \t and \n.
+type tsvRows struct {
+	reader    *bufio.Reader
+	line      int
+	columns   []string
+	nullValue string
+	close     func() error
+}
+
+func newTSVRows(r io.Reader, nullValue string, close func() error) (*tsvRows, error) {
+	rows := &tsvRows{reader: bufio.NewReader(r), nullValue: nullValue, close: close}
+	headers, err := rows.readLine()
+	if err == io.EOF {
+		return nil, fmt.Errorf("TSV file has no columns")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TSV headers: %w", err)
+	}
+	for _, header := range headers {
+		rows.columns = append(rows.columns, unescapeTSV(header))
+	}
+	return rows, nil
+}
+
+// readLine returns the raw fields of the next line
+func (r *tsvRows) readLine() ([]string, error) {
+	text, err := r.reader.ReadString('\n')
+	if err == io.EOF && text == "" {
+		return nil, io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	r.line++
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "\n"), "\r")
+	return strings.Split(text, "\t"), nil
+}
+
+func (r *tsvRows) Columns() []string {
+	return r.columns
+}
+
+func (r *tsvRows) Read() (dataRow, error) {
+	fields, err := r.readLine()
+	if err == io.EOF {
+		return dataRow{}, err
+	}
+	if err != nil {
+		return dataRow{}, fmt.Errorf("error reading TSV: %w", err)
+	}
+	if len(fields) != len(r.columns) {
+		return dataRow{}, fmt.Errorf("line %d has %d columns, expected %d", r.line, len(fields), len(r.columns))
+	}
+
+	// NULL is matched before unescaping, so the default \N is not read as "N"
+	nulls := textNulls(fields, r.nullValue)
+	for i, field := range fields {
+		fields[i] = unescapeTSV(field)
+	}
+	return dataRow{Line: r.line, Fields: fields, Nulls: nulls}, nil
+}
+
+func (r *tsvRows) Close() error {
+	return r.close()
+}
+
+// tsvEscapes maps the character after a backslash in a TSV field to the character it stands for
+var tsvEscapes = map[byte]byte{'b': '\b', 'f': '\f', 'r': '\r', 'n': '\n', 't': '\t', '0': 0}
+
+// unescapeTSV returns the value of a TSV field
+func unescapeTSV(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		c := field[i]
+		if c == '\\' && i+1 < len(field) {
+			i++
+			c = field[i]
+			if unescaped, ok := tsvEscapes[c]; ok {
+				c = unescaped
+			}
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// jsonRows reads a JSONEachRow (NDJSON) file: one JSON object per line. The keys of
+// the first object name the columns; keys missing from later objects are marked in
+// dataRow.Missing, so they get their column defaults.
+type jsonRows struct {
+	reader  *bufio.Reader
+	line    int
+	columns []string
+	index   map[string]int
+	first   []byte // First object, read to find the columns
+	close   func() error
+}
+
+func newJSONRows(r io.Reader, close func() error) (*jsonRows, error) {
+	rows := &jsonRows{reader: bufio.NewReader(r), close: close}
+	first, err := rows.readLine()
+	if err == io.EOF {
+		return rows, nil // No rows and no columns
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JSON: %w", err)
+	}
+	columns, err := objectKeys(first)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", rows.line, err)
+	}
+	rows.columns = columns
+	rows.index = make(map[string]int, len(columns))
+	for i, column := range columns {
+		rows.index[column] = i
+	}
+	rows.first = first
+	return rows, nil
+}
+
+// readLine returns the next line that is not blank
+func (r *jsonRows) readLine() ([]byte, error) {
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(line) > 0 {
+			r.line++
+		}
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			return trimmed, nil
+		}
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+	}
+}
+
+func (r *jsonRows) Columns() []string {
+	return r.columns
+}
+
+func (r *jsonRows) Read() (dataRow, error) {
+	line := r.first
+	r.first = nil
+	if line == nil {
+		var err error
+		if line, err = r.readLine(); err == io.EOF {
+			return dataRow{}, err
+		} else if err != nil {
+			return dataRow{}, fmt.Errorf("error reading JSON: %w", err)
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	var object map[string]any
+	if err := decoder.Decode(&object); err != nil || object == nil {
+		return dataRow{}, fmt.Errorf("line %d is not a JSON object", r.line)
+	}
+
+	row := dataRow{Line: r.line, Fields: make([]string, len(r.columns)), Nulls: make([]bool, len(r.columns))}
+	if len(object) < len(r.columns) {
+		row.Missing = make([]bool, len(r.columns))
+		for i := range row.Missing {
+			row.Missing[i] = true // Until the object has the key
+		}
+	}
+	for key, value := range object {
+		i, ok := r.index[key]
+		if !ok {
+			return dataRow{}, fmt.Errorf("line %d has key %q, which is not in the first row", r.line, key)
+		}
+		text, null, err := jsonFieldText(value)
+		if err != nil {
+			return dataRow{}, fmt.Errorf("line %d, column %s: %w", r.line, key, err)
+		}
+		row.Fields[i], row.Nulls[i] = text, null
+		if row.Missing != nil {
+			row.Missing[i] = false
+		}
+	}
+	return row, nil
+}
+
+func (r *jsonRows) Close() error {
+	return r.close()
+}
+
+// objectKeys returns the keys of a JSON object in the order they appear
+func objectKeys(data []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, errors.New("not a JSON object")
+	}
+	var keys []string
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+		keys = append(keys, token.(string))
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("invalid JSON: %w", err)
+		}
+	}
+	return keys, nil
+}
+
+// jsonFieldText returns the text of a JSON value as the converters read it. Arrays
+// become array literals such as [1,'a'].
+func jsonFieldText(value any) (text string, null bool, err error) {
+	switch v := value.(type) {
+	case nil:
+		return "", true, nil
+	case string:
+		return v, false, nil
+	case json.Number:
+		return v.String(), false, nil
+	case bool:
+		if v {
+			return "true", false, nil
+		}
+		return "false", false, nil
+	case []any:
+		text, err := jsonArrayLiteral(v)
+		return text, false, err
+	}
+	// Objects are passed as JSON text, e.g. for JSON columns
+	data, err := json.Marshal(value)
+	return string(data), false, err
+}
+
+// literalEscaper escapes strings quoted in array literals
+var literalEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// jsonArrayLiteral returns a JSON array as an array literal
+func jsonArrayLiteral(values []any) (string, error) {
+	elements := make([]string, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case nil:
+			elements[i] = "NULL"
+		case string:
+			elements[i] = "'" + literalEscaper.Replace(v) + "'"
+		case []any:
+			nested, err := jsonArrayLiteral(v)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = nested
+		case map[string]any:
+			return "", errors.New("objects in arrays are not supported")
+		default:
+			text, _, err := jsonFieldText(v)
+			if err != nil {
+				return "", err
+			}
+			elements[i] = text
+		}
+	}
+	return "[" + strings.Join(elements, ",") + "]", nil
+}
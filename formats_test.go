@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestParseDataFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		want dataFileName
+		ok   bool
+	}{
+		{"users.csv", dataFileName{Table: "users", Format: formatCSV}, true},
+		{"users.tsv", dataFileName{Table: "users", Format: formatTSV}, true},
+		{"events.ndjson", dataFileName{Table: "events", Format: formatJSONEachRow}, true},
+		{"events.jsonl.zst", dataFileName{Table: "events", Format: formatJSONEachRow, Compression: ".zst"}, true},
+		{"events.csv.gz", dataFileName{Table: "events", Format: formatCSV, Compression: ".gz"}, true},
+		{"events.parquet", dataFileName{}, false},
+		{"README.md", dataFileName{}, false},
+		{"events.gz", dataFileName{}, false},
+		{".csv", dataFileName{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseDataFileName(tt.name)
+		if ok != tt.ok || got != tt.want {
+			t.Errorf("parseDataFileName(%q) = %+v, %v, want %+v, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// readAllRows opens a data file and returns its columns and rows
+func readAllRows(t *testing.T, path, nullValue string) ([]string, []dataRow) {
+	t.Helper()
+	name, ok := parseDataFileName(filepath.Base(path))
+	if !ok {
+		t.Fatalf("%s is not a data file", path)
+	}
+	reader, err := openDataFile(path, name, nullValue)
+	if err != nil {
+		t.Fatalf("openDataFile failed: %v", err)
+	}
+	defer reader.Close()
+
+	var rows []dataRow
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		row.Fields = append([]string(nil), row.Fields...)
+		rows = append(rows, row)
+	}
+	return reader.Columns(), rows
+}
+
+func TestCSVRowsNullValue(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "users.csv", "id,name\n1,NULL\n2,\\N\n")
+
+	_, rows := readAllRows(t, path, "NULL")
+	if !reflect.DeepEqual(rows[0].Nulls, []bool{false, true}) {
+		t.Errorf("expected NULL to be NULL with -null-value NULL, got %v", rows[0].Nulls)
+	}
+	if rows[1].Nulls != nil || rows[1].Fields[1] != `\N` {
+		t.Errorf(`expected \N to be text with -null-value NULL, got %+v`, rows[1])
+	}
+}
+
+func TestTSVRows(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "users.tsv", "id\tname\tnote\n1\tfoo\\tbar\t\\N\n2\tline\\nbreak\tit's\r\n")
+
+	columns, rows := readAllRows(t, path, defaultNullValue)
+	if !reflect.DeepEqual(columns, []string{"id", "name", "note"}) {
+		t.Errorf("unexpected columns %v", columns)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(rows))
+	}
+	if !reflect.DeepEqual(rows[0].Fields[:2], []string{"1", "foo\tbar"}) || !reflect.DeepEqual(rows[0].Nulls, []bool{false, false, true}) {
+		t.Errorf("unexpected first row %+v", rows[0])
+	}
+	if !reflect.DeepEqual(rows[1].Fields, []string{"2", "line\nbreak", "it's"}) || rows[1].Line != 3 {
+		t.Errorf("unexpected second row %+v", rows[1])
+	}
+
+	bad := writeTestFile(t, t.TempDir(), "users.tsv", "id\tname\n1\n")
+	reader, err := openDataFile(bad, dataFileName{Table: "users", Format: formatTSV}, defaultNullValue)
+	if err != nil {
+		t.Fatalf("openDataFile failed: %v", err)
+	}
+	defer reader.Close()
+	if _, err := reader.Read(); err == nil || !strings.Contains(err.Error(), "line 2 has 1 columns, expected 2") {
+		t.Errorf("expected a column count error, got %v", err)
+	}
+}
+
+func TestJSONRows(t *testing.T) {
+	content := `{"id": 1, "name": "foo", "tags": ["a", "it's"], "score": null}
+
+{"score": 2.5, "id": 2}
+{"id": 3, "name": "", "tags": [[1, 2], null]}
+`
+	path := writeTestFile(t, t.TempDir(), "events.ndjson", content)
+
+	columns, rows := readAllRows(t, path, defaultNullValue)
+	if !reflect.DeepEqual(columns, []string{"id", "name", "tags", "score"}) {
+		t.Errorf("expected the keys of the first row in order, got %v", columns)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if !reflect.DeepEqual(rows[0].Fields, []string{"1", "foo", `['a','it\'s']`, ""}) ||
+		!reflect.DeepEqual(rows[0].Nulls, []bool{false, false, false, true}) {
+		t.Errorf("unexpected first row %+v", rows[0])
+	}
+	if rows[0].Missing != nil {
+		t.Errorf("expected no missing keys in the first row, got %+v", rows[0])
+	}
+	if rows[1].Line != 3 || !reflect.DeepEqual(rows[1].Missing, []bool{false, true, true, false}) {
+		t.Errorf("expected missing keys to be marked on line 3, got %+v", rows[1])
+	}
+	if !reflect.DeepEqual(rows[2].Fields[1:3], []string{"", "[[1,2],NULL]"}) || rows[2].Nulls[1] {
+		t.Errorf("unexpected third row %+v", rows[2])
+	}
+}
+
+func TestJSONRowsErrors(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		errMsg  string
+	}{
+		{`{"id": 1}` + "\n" + `{"id": 2, "extra": 1}`, `line 2 has key "extra", which is not in the first row`},
+		{`{"id": 1}` + "\n" + `[1, 2]`, "line 2 is not a JSON object"},
+		{`{"id": 1}` + "\n" + `{"id": [{"a": 1}]}`, "line 2, column id: objects in arrays are not supported"},
+	}
+	for _, tt := range tests {
+		path := writeTestFile(t, dir, "events.ndjson", tt.content)
+		reader, err := openDataFile(path, dataFileName{Table: "events", Format: formatJSONEachRow}, defaultNullValue)
+		if err != nil {
+			t.Fatalf("openDataFile failed: %v", err)
+		}
+		for err == nil {
+			_, err = reader.Read()
+		}
+		reader.Close()
+		if !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("expected error containing %q, got %v", tt.errMsg, err)
+		}
+	}
+}
+
+func TestLoadJSONRowsMissingKeysUseDefaults(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "events.ndjson",
+		`{"id": 1, "name": "a", "score": 1.5}`+"\n"+`{"id": 2}`+"\n"+`{"id": 3, "name": "c", "score": 2}`+"\n")
+	mock := &MockExecutor{tables: map[string][]tableColumn{
+		"events": {{Name: "id", Type: "UInt32"}, {Name: "name", Type: "String"}, {Name: "score", Type: "Float64", DefaultKind: "DEFAULT"}},
+	}}
+
+	name := dataFileName{Table: "events", Format: formatJSONEachRow}
+	rows, err := loadDataFileWithWriter(withRunID(ctxbg, "run1"), mock, path, "events.ndjson", name, dataLoadOptions{}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataFileWithWriter failed: %v", err)
+	}
+	if rows != 3 {
+		t.Errorf("expected 3 rows loaded, got %d", rows)
+	}
+	if len(mock.inserts) != 2 {
+		t.Fatalf("expected a batch per set of keys, got %+v", mock.inserts)
+	}
+	full, partial := mock.inserts[0], mock.inserts[1]
+	if !reflect.DeepEqual(full.columns, []string{"id", "name", "score"}) || len(full.rows) != 2 {
+		t.Errorf("expected the complete rows in one batch, got %+v", full)
+	}
+	if !reflect.DeepEqual(partial.columns, []string{"id"}) || !reflect.DeepEqual(partial.rows, [][]any{{uint32(2)}}) {
+		t.Errorf("expected the row without name and score to leave them out, got %+v", partial)
+	}
+	if full.queryID != "run1-data-events.ndjson-1" || partial.queryID != "run1-data-events.ndjson-2" {
+		t.Errorf("expected a query ID per batch, got %q and %q", full.queryID, partial.queryID)
+	}
+}
+
+// openBatchExecutor records the highest number of batches open at once
+type openBatchExecutor struct {
+	MockExecutor
+	open, peak int
+}
+
+func (m *openBatchExecutor) PrepareBatch(ctx context.Context, table string, columns []string) (Batch, error) {
+	batch, err := m.MockExecutor.PrepareBatch(ctx, table, columns)
+	m.open++
+	m.peak = max(m.peak, m.open)
+	return &openBatch{Batch: batch, executor: m}, err
+}
+
+// openBatch closes its place in openBatchExecutor when sent or aborted
+type openBatch struct {
+	Batch
+	executor *openBatchExecutor
+}
+
+func (b *openBatch) Send() error {
+	b.executor.open--
+	return b.Batch.Send()
+}
+
+func (b *openBatch) Abort() error {
+	b.executor.open--
+	return b.Batch.Abort()
+}
+
+func TestLoadJSONRowsManyKeySets(t *testing.T) {
+	columns := []tableColumn{{Name: "id", Type: "UInt32"}}
+	first := map[string]any{"id": 0}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("c%d", i)
+		columns = append(columns, tableColumn{Name: name, Type: "UInt32", DefaultKind: "DEFAULT"})
+		first[name] = 0
+	}
+	line, _ := json.Marshal(first)
+	content := string(line) + "\n"
+	// Every other row leaves out a different set of keys
+	for id := 1; id < 32; id++ {
+		row := map[string]any{"id": id}
+		for i := 0; i < 5; i++ {
+			if id&(1<<i) == 0 {
+				row[fmt.Sprintf("c%d", i)] = i
+			}
+		}
+		line, _ := json.Marshal(row)
+		content += string(line) + "\n"
+	}
+	path := writeTestFile(t, t.TempDir(), "events.ndjson", content)
+	mock := &openBatchExecutor{}
+	mock.tables = map[string][]tableColumn{"events": columns}
+
+	name := dataFileName{Table: "events", Format: formatJSONEachRow}
+	rows, err := loadDataFileWithWriter(ctxbg, mock, path, "events.ndjson", name, dataLoadOptions{}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataFileWithWriter failed: %v", err)
+	}
+	if rows != 32 {
+		t.Errorf("expected 32 rows loaded, got %d", rows)
+	}
+	if mock.peak > maxOpenBatches || mock.open != 0 {
+		t.Errorf("expected at most %d batches open at once and none left, got %d and %d", maxOpenBatches, mock.peak, mock.open)
+	}
+	sent := 0
+	for _, insert := range mock.inserts {
+		sent += len(insert.rows)
+	}
+	if sent != 32 {
+		t.Errorf("expected every row sent, got %d", sent)
+	}
+}
+
+func TestLoadCompressedDataFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write([]byte("id,name\n1,foo\n2,bar\n"))
+	gw.Close()
+	writeTestFile(t, dir, "users.csv.gz", gz.String())
+
+	var zst bytes.Buffer
+	zw, err := zstd.NewWriter(&zst)
+	if err != nil {
+		t.Fatalf("zstd.NewWriter failed: %v", err)
+	}
+	zw.Write([]byte(`{"id": 7, "at": "2026-10-18 14:30:00"}` + "\n"))
+	zw.Close()
+	writeTestFile(t, dir, "events.ndjson.zst", zst.String())
+
+	writeTestFile(t, dir, "notes.txt", "not a data file")
+
+	mock := &MockExecutor{tables: map[string][]tableColumn{
+		"users":  {{Name: "id", Type: "UInt32"}, {Name: "name", Type: "String"}},
+		"events": {{Name: "id", Type: "Int64"}, {Name: "at", Type: "DateTime"}},
+	}}
+	loaded, err := loadDataWithWriter(ctxbg, mock, dir, dataLoadOptions{nullValue: defaultNullValue}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+
+	got := map[string]int{}
+	for _, f := range loaded {
+		got[f.File+" -> "+f.Table] = f.Rows
+	}
+	want := map[string]int{"events.ndjson.zst -> events": 1, "users.csv.gz -> users": 2}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v loaded, got %v", want, got)
+	}
+	for _, insert := range mock.inserts {
+		if strings.Contains(insert.table, "events") && insert.rows[0][0] != int64(7) {
+			t.Errorf("expected JSON numbers converted to the column type, got %#v", insert.rows[0][0])
+		}
+	}
+}
+
+func TestLoadDataRejectsParquet(t *testing.T) {
+	for _, tt := range []struct{ name, list string }{
+		{"events.parquet", ""},
+		{"analytics/events.parquet.gz", ""},
+		{"events.parquet", "events.parquet"},
+	} {
+		dir := t.TempDir()
+		writeTestFile(t, dir, "users.csv", "id\n1\n")
+		writeTestFile(t, dir, tt.name, "PAR1")
+		if tt.list != "" {
+			writeTestFile(t, dir, "data.lst", "users.csv\n"+tt.list+"\n")
+		}
+
+		mock := &MockExecutor{tables: map[string][]tableColumn{"users": stringColumns("id")}}
+		_, err := loadDataWithWriter(ctxbg, mock, dir, dataLoadOptions{}, testLogger(io.Discard))
+		if err == nil || !strings.Contains(err.Error(), "Parquet files are not supported yet") {
+			t.Errorf("%s: expected a Parquet error, got %v", tt.name, err)
+		}
+		if len(mock.inserts) != 0 {
+			t.Errorf("%s: expected nothing loaded, got %+v", tt.name, mock.inserts)
+		}
+	}
+}
+
+func TestOpenDataFileNotFound(t *testing.T) {
+	_, err := openDataFile(filepath.Join(t.TempDir(), "missing.csv"), dataFileName{Table: "missing", Format: formatCSV}, "")
+	if err == nil || !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
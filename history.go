@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// historyLimit is the number of runs listed by -history
+const historyLimit = 20
+
+// Values of the dbmigrate_runs outcome column
+const (
+	outcomeRunning     = "running"
+	outcomeSuccess     = "success"
+	outcomeFailed      = "failed"
+	outcomeInterrupted = "interrupted"
+)
+
+// createRunsTableSQL creates the run history table. Each run writes a row when it
+// starts and another when it ends; ReplacingMergeTree keeps the later one.
+const createRunsTableSQL = `CREATE TABLE IF NOT EXISTS dbmigrate_runs (
+    run_id String,
+    revision UInt8,
+    started_at DateTime64(3),
+    finished_at Nullable(DateTime64(3)),
+    outcome LowCardinality(String),
+    command LowCardinality(String),
+    applied UInt32,
+    skipped UInt32,
+    failed UInt32,
+    statements UInt32,
+    error String,
+    flags String,
+    tool_version String
+) ENGINE = ReplacingMergeTree(revision)
+ORDER BY run_id`
+
+// runRecord is a row of the dbmigrate_runs table
+type runRecord struct {
+	RunID       string
+	StartedAt   time.Time
+	FinishedAt  time.Time // Zero while running, or if the run never finished
+	Outcome     string
+	Command     string
+	Applied     int
+	Skipped     int
+	Failed      int
+	Statements  int
+	Error       string
+	Flags       string
+	ToolVersion string
+}
+
+// runHistory records a run in dbmigrate_runs. A nil runHistory records nothing, so
+// a run whose start could not be recorded goes on without history.
+type runHistory struct {
+	executor DatabaseExecutor
+	record   runRecord
+}
+
+// startRunHistory creates dbmigrate_runs if needed and records the start of a run.
+// History is bookkeeping only, so failures are logged and return nil.
+func startRunHistory(executor DatabaseExecutor, runID, command, flags string, logger *Logger) *runHistory {
+	h := &runHistory{
+		executor: executor,
+		record: runRecord{
+			RunID:       runID,
+			StartedAt:   time.Now(),
+			Outcome:     outcomeRunning,
+			Command:     command,
+			Flags:       flags,
+			ToolVersion: Version,
+		},
+	}
+	if err := executor.Execute(ctxbg, createRunsTableSQL); err != nil {
+		logger.Warnf("Could not create dbmigrate_runs, the run is not recorded: %v", err)
+		return nil
+	}
+	if err := h.write(0); err != nil {
+		logger.Warnf("Could not record the run in dbmigrate_runs: %v", err)
+		return nil
+	}
+	return h
+}
+
+// finish records the outcome of the run
+func (h *runHistory) finish(code int, report *runReport, logger *Logger) {
+	if h == nil {
+		return
+	}
+
+	h.record.FinishedAt = time.Now()
+	switch code {
+	case 0:
+		h.record.Outcome = outcomeSuccess
+	case exitInterrupted:
+		h.record.Outcome = outcomeInterrupted
+	default:
+		h.record.Outcome = outcomeFailed
+	}
+	h.record.Error = report.Error
+	if migrate := report.Migrate; migrate != nil {
+		h.record.Applied = len(migrate.Applied)
+		h.record.Skipped = len(migrate.Skipped)
+		h.record.Failed = len(migrate.Failed)
+		h.record.Statements = migrate.Statements
+	}
+
+	if err := h.write(1); err != nil {
+		logger.Warnf("Could not record the end of the run in dbmigrate_runs: %v", err)
+	}
+}
+
+// write inserts the current state of the record with the given revision
+func (h *runHistory) write(revision int) error {
+	r := h.record
+	finishedAt := "NULL"
+	if !r.FinishedAt.IsZero() {
+		finishedAt = sqlTime(r.FinishedAt)
+	}
+	sql := fmt.Sprintf(
+		"INSERT INTO dbmigrate_runs (run_id, revision, started_at, finished_at, outcome, command, applied, skipped, failed, statements, error, flags, tool_version) VALUES ('%s', %d, %s, %s, '%s', '%s', %d, %d, %d, %d, '%s', '%s', '%s')",
+		escapeSQLString(r.RunID),
+		revision,
+		sqlTime(r.StartedAt),
+		finishedAt,
+		escapeSQLString(r.Outcome),
+		escapeSQLString(r.Command),
+		r.Applied, r.Skipped, r.Failed, r.Statements,
+		escapeSQLString(r.Error),
+		escapeSQLString(r.Flags),
+		escapeSQLString(r.ToolVersion),
+	)
+	return h.executor.Execute(ctxbg, sql)
+}
+
+// sqlTime formats t as a DateTime64(3) literal in UTC
+func sqlTime(t time.Time) string {
+	return fmt.Sprintf("toDateTime64('%s', 3, 'UTC')", t.UTC().Format("2006-01-02 15:04:05.000"))
+}
+
+// redactedFlags returns the command line of a run for dbmigrate_runs, with secrets
+// such as the password replaced. The password in a -dsn value is replaced however
+// it is encoded.
+func redactedFlags(args []string, logger *Logger) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if name, value, ok := strings.Cut(arg, "="); ok && (name == "-dsn" || name == "--dsn") {
+			arg = name + "=" + redactDSN(value)
+		} else if i > 0 && (args[i-1] == "-dsn" || args[i-1] == "--dsn") {
+			arg = redactDSN(arg)
+		}
+		if strings.ContainsAny(arg, " \t'\"") {
+			arg = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+		quoted[i] = arg
+	}
+	return logger.Redact(strings.Join(quoted, " "))
+}
+
+// getRunHistory returns the most recent runs, newest first
+func getRunHistory(executor DatabaseExecutor, limit int) ([]runRecord, error) {
+	rows, err := executor.Query(ctxbg, fmt.Sprintf(`
+		SELECT *
+		FROM dbmigrate_runs FINAL
+		ORDER BY started_at DESC
+		LIMIT %d
+	`, limit))
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]runRecord, 0, len(rows))
+	for _, row := range rows {
+		records = append(records, runRecordFromRow(row))
+	}
+	return records, nil
+}
+
+// runRecordFromRow converts a dbmigrate_runs row
+func runRecordFromRow(row map[string]interface{}) runRecord {
+	var r runRecord
+	r.RunID, _ = row["run_id"].(string)
+	r.StartedAt, _ = row["started_at"].(time.Time)
+	switch finishedAt := row["finished_at"].(type) {
+	case time.Time:
+		r.FinishedAt = finishedAt
+	case *time.Time:
+		if finishedAt != nil {
+			r.FinishedAt = *finishedAt
+		}
+	}
+	r.Outcome, _ = row["outcome"].(string)
+	r.Command, _ = row["command"].(string)
+	r.Applied = int(toInt64(row["applied"]))
+	r.Skipped = int(toInt64(row["skipped"]))
+	r.Failed = int(toInt64(row["failed"]))
+	r.Statements = int(toInt64(row["statements"]))
+	r.Error, _ = row["error"].(string)
+	r.Flags, _ = row["flags"].(string)
+	r.ToolVersion, _ = row["tool_version"].(string)
+	return r
+}
+
+// showRunHistoryWithWriter prints the -history table
+func showRunHistoryWithWriter(records []runRecord, logger *Logger) {
+	if len(records) == 0 {
+		logger.Printf("No runs have been recorded yet.")
+		return
+	}
+
+	tw := tabwriter.NewWriter(logger.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STARTED AT\tDURATION\tOUTCOME\tAPPLIED\tSKIPPED\tFAILED\tVERSION\tRUN ID")
+	for _, r := range records {
+		duration := "-"
+		if !r.FinishedAt.IsZero() {
+			duration = r.FinishedAt.Sub(r.StartedAt).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%d\t%s\t%s\n",
+			r.StartedAt.Format("2006-01-02 15:04:05"), duration, r.Outcome,
+			r.Applied, r.Skipped, r.Failed, r.ToolVersion, r.RunID)
+	}
+	tw.Flush()
+
+	for _, r := range records {
+		if r.Error != "" {
+			logger.Printf("")
+			logger.Printf("Last error (run %s): %s", r.RunID, r.Error)
+			break
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunRecordsHistory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+
+	mock := &interruptExecutor{}
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-password", "s3cret"},
+		Executor: mock,
+	}
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	if len(mock.historySQL) != 3 {
+		t.Fatalf("expected CREATE TABLE and two INSERTs into dbmigrate_runs, got %v", mock.historySQL)
+	}
+	if !strings.HasPrefix(mock.historySQL[0], "CREATE TABLE IF NOT EXISTS dbmigrate_runs") {
+		t.Errorf("expected dbmigrate_runs to be created first, got %s", mock.historySQL[0])
+	}
+	start, end := mock.historySQL[1], mock.historySQL[2]
+	if !strings.Contains(start, "'running'") || !strings.Contains(start, "NULL") {
+		t.Errorf("expected a running row without finished_at, got %s", start)
+	}
+	if !strings.Contains(end, "'success', 'migrate', 1, 0, 0, 1") {
+		t.Errorf("expected a success row with counts, got %s", end)
+	}
+	if strings.Contains(end, "s3cret") || !strings.Contains(end, "-password ********") {
+		t.Errorf("expected the password to be redacted from the flags, got %s", end)
+	}
+}
+
+func TestRunRecordsFailedHistory(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := writeTestFile(t, dir, "index.lst", "missing.sql\n")
+
+	mock := &interruptExecutor{}
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath},
+		Executor: mock,
+	}
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+	if len(mock.historySQL) != 3 || !strings.Contains(mock.historySQL[2], "'failed'") {
+		t.Errorf("expected the failure before any migration to be recorded, got %v", mock.historySQL)
+	}
+}
+
+func TestRunStatusDoesNotRecordHistory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+
+	mock := &interruptExecutor{}
+	cfg := RunConfig{
+		Stdout:   &bytes.Buffer{},
+		Stderr:   &bytes.Buffer{},
+		Args:     []string{"-path", indexPath, "-status"},
+		Executor: mock,
+	}
+	run(cfg)
+	if len(mock.historySQL) != 0 {
+		t.Errorf("expected -status not to be recorded, got %v", mock.historySQL)
+	}
+}
+
+func historyRows() []map[string]interface{} {
+	started := time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)
+	finished := started.Add(1500 * time.Millisecond)
+	return []map[string]interface{}{
+		{
+			"run_id": "run2", "started_at": started, "finished_at": &finished, "outcome": "failed",
+			"command": "migrate", "applied": uint32(1), "skipped": uint32(4), "failed": uint32(1),
+			"statements": uint32(3), "error": "002.sql: statement 1 failed", "flags": "-path index.lst", "tool_version": "1.4.0",
+		},
+		{
+			"run_id": "run1", "started_at": started.Add(-time.Hour), "finished_at": (*time.Time)(nil), "outcome": "running",
+			"command": "migrate", "tool_version": "1.4.0",
+		},
+	}
+}
+
+func TestShowRunHistory(t *testing.T) {
+	var out bytes.Buffer
+	mock := &MockExecutorWithRows{rows: historyRows()}
+	cfg := RunConfig{
+		Stdout:   &out,
+		Stderr:   &out,
+		Args:     []string{"-history"},
+		Executor: mock,
+	}
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, out.String())
+	}
+
+	output := out.String()
+	for _, want := range []string{"STARTED AT", "2026-10-18 09:00:00  1.5s", "failed", "run2", "run1", "Last error (run run2): 002.sql: statement 1 failed"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, output)
+		}
+	}
+	if len(mock.historySQL) != 0 {
+		t.Errorf("expected -history not to be recorded, got %v", mock.historySQL)
+	}
+}
+
+func TestShowRunHistoryJSON(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-history", "-output", "json"},
+		Executor: &MockExecutorWithRows{rows: historyRows()},
+	}
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	var report runReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, stdout.String())
+	}
+	if report.Command != "history" || len(report.Runs) != 2 {
+		t.Fatalf("expected 2 runs, got %+v", report)
+	}
+	if report.Runs[0].FinishedAt == nil || report.Runs[0].Applied != 1 || report.Runs[1].FinishedAt != nil {
+		t.Errorf("unexpected runs: %+v", report.Runs)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// indexContext holds what @if conditions in index files can test
+type indexContext struct {
+	Env  string
+	Tags []string
+	Vars map[string]string
+}
+
+// indexBlock is an open @if block in an index file
+type indexBlock struct {
+	matched bool // The @if condition held
+	inElse  bool // Past the block's @else
+}
+
+// indexBlocksActive reports whether lines inside the open @if blocks are included
+func indexBlocksActive(blocks []indexBlock) bool {
+	for _, b := range blocks {
+		if b.matched == b.inElse {
+			return false
+		}
+	}
+	return true
+}
+
+// eval evaluates an @if condition: name=value or name!=value, where value may be a
+// comma-separated list of alternatives. name is env, tag (any active tag) or a
+// template variable; an undefined variable matches no value.
+func (c indexContext) eval(cond string) (bool, error) {
+	negate := false
+	name, value, ok := strings.Cut(cond, "!=")
+	if ok {
+		negate = true
+	} else if name, value, ok = strings.Cut(cond, "="); !ok {
+		return false, fmt.Errorf("invalid @if condition %q: expected name=value or name!=value", cond)
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return false, fmt.Errorf("invalid @if condition %q: missing name", cond)
+	}
+
+	var actual []string
+	switch name {
+	case "env":
+		actual = []string{c.Env}
+	case "tag":
+		actual = c.Tags
+	default:
+		if v, ok := c.Vars[name]; ok {
+			actual = []string{v}
+		}
+	}
+
+	matched := false
+	for _, want := range strings.Split(value, ",") {
+		want = strings.TrimSpace(want)
+		for _, have := range actual {
+			if strings.EqualFold(want, have) {
+				matched = true
+			}
+		}
+	}
+	return matched != negate, nil
+}
+
+// includeDir adds the files in dir for which isEntry is true, such as .sql files,
+// sorted by name, for @include-dir
+func includeDir(dir string, files *[]string, isEntry func(name string) bool, logger *Logger) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("@include-dir: %w", err)
+	}
+	logger.Verbosef("Including directory: %v", dir)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !isEntry(entry.Name()) {
+			continue
+		}
+		*files = append(*files, filepath.Join(dir, entry.Name()))
+	}
+	return nil
+}
+
+// isSQLFile reports whether an index entry is a SQL file
+func isSQLFile(name string) bool {
+	return strings.HasSuffix(name, ".sql")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// collectIndex runs processWithWriter on an index and returns the collected file names
+func collectIndex(t *testing.T, indexPath string, ictx indexContext) ([]string, error) {
+	t.Helper()
+	var sqlfiles []string
+	err := processWithWriter(indexPath, &sqlfiles, ictx, testLogger(io.Discard))
+	names := make([]string, 0, len(sqlfiles))
+	for _, f := range sqlfiles {
+		rel, _ := filepath.Rel(filepath.Dir(indexPath), f)
+		names = append(names, filepath.ToSlash(rel))
+	}
+	return names, err
+}
+
+// ============================================================================
+// Tests for index directives
+// ============================================================================
+
+func TestProcessIfBlocks(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := writeTestFile(t, dir, "index.lst", `schema.sql
+@if env=prod
+replicated.sql
+@if region=eu,uk
+gdpr.sql
+@endif
+@else
+local.sql
+@endif
+@if env!=prod
+fixtures.sql
+@endif
+`)
+
+	tests := []struct {
+		ictx     indexContext
+		expected []string
+	}{
+		{indexContext{Env: "prod", Vars: map[string]string{"region": "eu"}}, []string{"schema.sql", "replicated.sql", "gdpr.sql"}},
+		{indexContext{Env: "prod", Vars: map[string]string{"region": "us"}}, []string{"schema.sql", "replicated.sql"}},
+		{indexContext{Env: "dev"}, []string{"schema.sql", "local.sql", "fixtures.sql"}},
+	}
+
+	for _, tt := range tests {
+		files, err := collectIndex(t, indexPath, tt.ictx)
+		if err != nil {
+			t.Fatalf("processWithWriter failed: %v", err)
+		}
+		if !reflect.DeepEqual(files, tt.expected) {
+			t.Errorf("env %s: expected %v, got %v", tt.ictx.Env, tt.expected, files)
+		}
+	}
+}
+
+func TestProcessIfTag(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := writeTestFile(t, dir, "index.lst", "@if tag=test\nfixtures.sql\n@endif\n")
+
+	files, err := collectIndex(t, indexPath, indexContext{Tags: []string{"ci", "test"}})
+	if err != nil {
+		t.Fatalf("processWithWriter failed: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"fixtures.sql"}) {
+		t.Errorf("expected fixtures.sql, got %v", files)
+	}
+}
+
+func TestProcessOptional(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "present.sql", "SELECT 1;")
+	writeTestFile(t, dir, "extra.lst", "present.sql\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "@optional present.sql\n@optional missing.sql\n@optional extra.lst\n@optional missing.lst\n")
+
+	files, err := collectIndex(t, indexPath, indexContext{})
+	if err != nil {
+		t.Fatalf("processWithWriter failed: %v", err)
+	}
+	if !reflect.DeepEqual(files, []string{"present.sql", "present.sql"}) {
+		t.Errorf("expected only present files, got %v", files)
+	}
+}
+
+func TestProcessIncludeDir(t *testing.T) {
+	dir := t.TempDir()
+	viewsDir := filepath.Join(dir, "views")
+	if err := os.MkdirAll(filepath.Join(viewsDir, "nested"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, viewsDir, "b_view.sql", "SELECT 1;")
+	writeTestFile(t, viewsDir, "a_view.sql", "SELECT 1;")
+	writeTestFile(t, viewsDir, "README.md", "docs")
+	writeTestFile(t, filepath.Join(viewsDir, "nested"), "c_view.sql", "SELECT 1;")
+	indexPath := writeTestFile(t, dir, "index.lst", "schema.sql\n@include-dir views/\n")
+
+	files, err := collectIndex(t, indexPath, indexContext{})
+	if err != nil {
+		t.Fatalf("processWithWriter failed: %v", err)
+	}
+	expected := []string{"schema.sql", "views/a_view.sql", "views/b_view.sql"}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected %v, got %v", expected, files)
+	}
+}
+
+func TestProcessDirectiveErrors(t *testing.T) {
+	tests := []struct {
+		index    string
+		contains string
+	}{
+		{"@if env\nx.sql\n@endif\n", "index.lst:1: invalid @if condition"},
+		{"@if env=prod\nx.sql\n", "@if without @endif"},
+		{"x.sql\n@endif\n", "index.lst:2: @endif without @if"},
+		{"@if env=prod\n@else\n@else\n@endif\n", "index.lst:3: @else without @if"},
+		{"@unless env=prod\n", "unknown directive @unless"},
+		{"@include-dir missing/\n", "@include-dir"},
+		{"@optional\n", "@optional needs a path"},
+	}
+
+	for _, tt := range tests {
+		indexPath := writeTestFile(t, t.TempDir(), "index.lst", tt.index)
+		_, err := collectIndex(t, indexPath, indexContext{Env: "prod"})
+		if err == nil || !strings.Contains(err.Error(), tt.contains) {
+			t.Errorf("index %q: expected error containing %q, got %v", tt.index, tt.contains, err)
+		}
+	}
+}
+
+func TestIndexContextEval(t *testing.T) {
+	ictx := indexContext{Env: "Prod", Vars: map[string]string{"cluster": "main"}}
+
+	tests := []struct {
+		cond     string
+		expected bool
+	}{
+		{"env=prod", true},
+		{"env = staging, prod", true},
+		{"env!=prod", false},
+		{"cluster=main", true},
+		{"undefined=x", false},
+		{"undefined!=x", true},
+	}
+
+	for _, tt := range tests {
+		result, err := ictx.eval(tt.cond)
+		if err != nil {
+			t.Fatalf("eval(%q) failed: %v", tt.cond, err)
+		}
+		if result != tt.expected {
+			t.Errorf("eval(%q) = %v, expected %v", tt.cond, result, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// LogLevel controls how much progress output is written
+type LogLevel int
+
+const (
+	LogQuiet   LogLevel = iota // Errors and command results only
+	LogNormal                  // Progress, warnings and summaries
+	LogVerbose                 // Per-file and per-statement details
+	LogDebug                   // Verbose plus ClickHouse driver protocol logging
+)
+
+// Logger writes progress to out and errors to err, honoring the log level
+// and whether ANSI colors should be used on each of them
+type Logger struct {
+	out      io.Writer
+	err      io.Writer
+	level    LogLevel
+	color    bool // Colors on out
+	errColor bool // Colors on err
+	secrets  []string
+	mu       sync.Mutex // Serializes lines written by concurrent migrations
+}
+
+// redactedText replaces secrets in everything the Logger writes
+const redactedText = "********"
+
+// NewLogger creates a Logger writing progress to out and errors to err, each
+// colored only when its color flag is set
+func NewLogger(out, err io.Writer, level LogLevel, color, errColor bool) *Logger {
+	return &Logger{out: out, err: err, level: level, color: color, errColor: errColor}
+}
+
+// colorEnabled reports whether ANSI colors should be written to w: only for
+// terminals, and never when the NO_COLOR environment variable is set
+func colorEnabled(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// AddSecret makes the Logger replace s with asterisks in everything it writes,
+// including driver debug output
+func (l *Logger) AddSecret(s string) {
+	if s != "" {
+		l.secrets = append(l.secrets, s)
+	}
+}
+
+// Redact returns s with every registered secret replaced
+func (l *Logger) Redact(s string) string {
+	for _, secret := range l.secrets {
+		s = strings.ReplaceAll(s, secret, redactedText)
+	}
+	return s
+}
+
+// writeLine writes a redacted line to w
+func (l *Logger) writeLine(w io.Writer, s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintln(w, l.Redact(s))
+}
+
+// paint wraps s in the given color code when colors are enabled on out
+func (l *Logger) paint(color, s string) string {
+	return paintIf(l.color, color, s)
+}
+
+// paintIf wraps s in the given color code when enabled is set
+func paintIf(enabled bool, color, s string) string {
+	if !enabled || s == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// Printf writes a line to out regardless of the log level, for command results and prompts
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.writeLine(l.out, fmt.Sprintf(format, args...))
+}
+
+// Infof writes a progress line to out unless running quietly
+func (l *Logger) Infof(format string, args ...interface{}) {
+	if l.level >= LogNormal {
+		l.writeLine(l.out, fmt.Sprintf(format, args...))
+	}
+}
+
+// Verbosef writes a dimmed detail line to out with -verbose
+func (l *Logger) Verbosef(format string, args ...interface{}) {
+	if l.level >= LogVerbose {
+		l.writeLine(l.out, l.paint(colorDim, fmt.Sprintf(format, args...)))
+	}
+}
+
+// Debugf writes a dimmed line to out with -debug
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.level >= LogDebug {
+		l.writeLine(l.out, l.paint(colorDim, fmt.Sprintf(format, args...)))
+	}
+}
+
+// Warnf writes a warning line to out unless running quietly
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	if l.level >= LogNormal {
+		l.writeLine(l.out, l.paint(colorYellow, "Warning:")+" "+fmt.Sprintf(format, args...))
+	}
+}
+
+// Errorf writes an error line to err regardless of the log level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.writeLine(l.err, paintIf(l.errColor, colorRed, "Error:")+" "+fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// Tests for Logger
+// ============================================================================
+
+func TestLoggerLevels(t *testing.T) {
+	tests := []struct {
+		level   LogLevel
+		info    bool
+		verbose bool
+		debug   bool
+	}{
+		{LogQuiet, false, false, false},
+		{LogNormal, true, false, false},
+		{LogVerbose, true, true, false},
+		{LogDebug, true, true, true},
+	}
+
+	for _, tt := range tests {
+		var out, errOut bytes.Buffer
+		logger := NewLogger(&out, &errOut, tt.level, false, false)
+
+		logger.Infof("info line")
+		logger.Verbosef("verbose line")
+		logger.Debugf("debug line")
+		logger.Printf("result line")
+		logger.Errorf("error line")
+
+		output := out.String()
+		if strings.Contains(output, "info line") != tt.info {
+			t.Errorf("level %d: info visibility expected %v, got %q", tt.level, tt.info, output)
+		}
+		if strings.Contains(output, "verbose line") != tt.verbose {
+			t.Errorf("level %d: verbose visibility expected %v, got %q", tt.level, tt.verbose, output)
+		}
+		if strings.Contains(output, "debug line") != tt.debug {
+			t.Errorf("level %d: debug visibility expected %v, got %q", tt.level, tt.debug, output)
+		}
+		if !strings.Contains(output, "result line") {
+			t.Errorf("level %d: results should always be printed, got %q", tt.level, output)
+		}
+		if !strings.Contains(errOut.String(), "Error: error line") {
+			t.Errorf("level %d: errors should always be printed, got %q", tt.level, errOut.String())
+		}
+	}
+}
+
+func TestLoggerWarnf(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, LogNormal, false, false)
+
+	logger.Warnf("disk %s", "full")
+
+	if out.String() != "Warning: disk full\n" {
+		t.Errorf("unexpected warning output %q", out.String())
+	}
+}
+
+func TestLoggerColors(t *testing.T) {
+	var out bytes.Buffer
+
+	colored := NewLogger(&out, &out, LogNormal, true, true)
+	if got := colored.paint(colorGreen, "ok"); got != colorGreen+"ok"+colorReset {
+		t.Errorf("expected colored text, got %q", got)
+	}
+
+	plain := NewLogger(&out, &out, LogNormal, false, false)
+	if got := plain.paint(colorGreen, "ok"); got != "ok" {
+		t.Errorf("expected plain text, got %q", got)
+	}
+
+	plain.Errorf("boom")
+	if strings.Contains(out.String(), "\033[") {
+		t.Errorf("expected no ANSI codes, got %q", out.String())
+	}
+}
+
+func TestLoggerColorsPerWriter(t *testing.T) {
+	var out, errOut bytes.Buffer
+
+	// e.g. dbmigrate 2>log on a terminal: colors on stdout only
+	logger := NewLogger(&out, &errOut, LogNormal, true, false)
+	logger.Warnf("slow")
+	logger.Errorf("boom")
+	if !strings.Contains(out.String(), colorYellow) {
+		t.Errorf("expected a colored warning on out, got %q", out.String())
+	}
+	if errOut.String() != "Error: boom\n" {
+		t.Errorf("expected a plain error on err, got %q", errOut.String())
+	}
+
+	out.Reset()
+	errOut.Reset()
+	logger = NewLogger(&out, &errOut, LogNormal, false, true)
+	logger.Warnf("slow")
+	logger.Errorf("boom")
+	if out.String() != "Warning: slow\n" {
+		t.Errorf("expected a plain warning on out, got %q", out.String())
+	}
+	if !strings.Contains(errOut.String(), colorRed) {
+		t.Errorf("expected a colored error on err, got %q", errOut.String())
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	var buf bytes.Buffer
+	if colorEnabled(&buf) {
+		t.Error("colors should be disabled for non-terminal writers")
+	}
+
+	t.Setenv("NO_COLOR", "1")
+	if colorEnabled(os.Stdout) {
+		t.Error("colors should be disabled when NO_COLOR is set")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tests := []struct {
+		cfg      RunConfig
+		expected LogLevel
+	}{
+		{RunConfig{}, LogNormal},
+		{RunConfig{Quiet: true}, LogQuiet},
+		{RunConfig{Verbose: true}, LogVerbose},
+		{RunConfig{Debug: true}, LogDebug},
+	}
+
+	for _, tt := range tests {
+		if level := logLevel(tt.cfg); level != tt.expected {
+			t.Errorf("logLevel(%+v) = %d, expected %d", tt.cfg, level, tt.expected)
+		}
+	}
+}
+
+func TestRunQuiet(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-quiet"},
+		Executor: &MockExecutor{},
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected no output with -quiet, got %q", stdout.String())
+	}
+}
+
+func TestRunConnectMessageUsesStdout(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+
+	var stdout, stderr bytes.Buffer
+	cfg := DefaultRunConfig()
+	cfg.Stdout = &stdout
+	cfg.Stderr = &stderr
+	cfg.Args = []string{"-path", indexPath, "-h", "db.example.com"}
+	cfg.Executor = &MockExecutor{}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	if !strings.Contains(stdout.String(), "Connected to default@db.example.com:9000/default") {
+		t.Errorf("expected connect message on configured stdout, got %q", stdout.String())
+	}
+	if strings.Contains(stdout.String(), "\033[") {
+		t.Errorf("expected no ANSI codes for non-terminal output, got %q", stdout.String())
+	}
+}
+
+func TestRunQuietAndVerbose(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-quiet", "-verbose"},
+		Executor: &MockExecutor{},
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "-quiet cannot be combined") {
+		t.Errorf("expected conflict error, got %q", stderr.String())
+	}
+}
+
+func TestLoggerRedactsSecrets(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, &out, LogDebug, false, false)
+	logger.AddSecret("s3cret")
+	logger.AddSecret("")
+
+	logger.Debugf("[clickhouse] auth password=%s", "s3cret")
+	logger.Errorf("login failed for s3cret")
+
+	if strings.Contains(out.String(), "s3cret") {
+		t.Errorf("expected secret to be redacted, got %q", out.String())
+	}
+	if strings.Count(out.String(), redactedText) != 2 {
+		t.Errorf("expected two redactions, got %q", out.String())
+	}
+}
@@ -5,24 +5,33 @@ import (
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // process is a helper for backward compatibility in tests
 func process(path string, sqlfiles *[]string) error {
-	return processWithWriter(path, sqlfiles, io.Discard, false)
+	return processWithWriter(path, sqlfiles, indexContext{}, testLogger(io.Discard))
 }
 
 // executeSQL is a helper for backward compatibility in tests
 func executeSQL(executor DatabaseExecutor, path string) error {
-	_, err := executeSQLWithWriter(executor, path, io.Discard, false)
+	_, err := executeSQLWithWriter(ctxbg, executor, MigrationInfo{Path: path}, sqlSource{}, retryPolicy{}, testLogger(io.Discard))
 	return err
 }
 
+// testLogger returns a Logger writing everything to w without colors
+func testLogger(w io.Writer) *Logger {
+	return NewLogger(w, w, LogNormal, false, false)
+}
+
 func TestProcess(t *testing.T) {
 	// Create a temporary directory for test files
 	tmpDir, err := os.MkdirTemp("", "dbversion-test")
@@ -222,11 +231,18 @@ func TestDefaultPorts(t *testing.T) {
 
 // MockExecutor for testing executeSQL function
 type MockExecutor struct {
-	executedSQL []string
-	shouldError bool
+	mu             sync.Mutex
+	executedSQL    []string
+	historySQL     []string // Statements on dbmigrate_runs, kept apart from the migration SQL
+	inserts        []mockInsert
+	tables         map[string][]tableColumn // Columns returned by DESCRIBE TABLE
+	killedQueries  []string
+	shouldError    bool
+	connectOptions ConnectOptions
 }
 
-func (m *MockExecutor) Connect(host string, port int, database string, username string, password string, debug bool) error {
+func (m *MockExecutor) Connect(opts ConnectOptions) error {
+	m.connectOptions = opts
 	return nil
 }
 
@@ -234,7 +250,21 @@ func (m *MockExecutor) Execute(ctx context.Context, sql string) error {
 	if m.shouldError {
 		return context.DeadlineExceeded
 	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.Contains(sql, "dbmigrate_runs") {
+		m.historySQL = append(m.historySQL, sql)
+		return nil
+	}
 	m.executedSQL = append(m.executedSQL, sql)
+	// Staging tables get the columns of the table they are created as
+	if rest, ok := strings.CutPrefix(sql, "CREATE TABLE "); ok {
+		if table, like, ok := strings.Cut(rest, " AS "); ok {
+			if columns, ok := m.tables[strings.Fields(like)[0]]; ok {
+				m.tables[table] = columns
+			}
+		}
+	}
 	return nil
 }
 
@@ -242,9 +272,73 @@ func (m *MockExecutor) Query(ctx context.Context, sql string) ([]map[string]inte
 	if m.shouldError {
 		return nil, context.DeadlineExceeded
 	}
+	if table, ok := strings.CutPrefix(sql, "DESCRIBE TABLE "); ok {
+		columns, ok := m.tables[table]
+		if !ok {
+			return nil, fmt.Errorf("Table default.%s does not exist", table)
+		}
+		var rows []map[string]interface{}
+		for _, c := range columns {
+			rows = append(rows, map[string]interface{}{"name": c.Name, "type": c.Type, "default_type": c.DefaultKind})
+		}
+		return rows, nil
+	}
 	return nil, nil
 }
 
+// stringColumns returns String columns with the given names, for MockExecutor.tables
+func stringColumns(names ...string) []tableColumn {
+	columns := make([]tableColumn, len(names))
+	for i, name := range names {
+		columns[i] = tableColumn{Name: name, Type: "String"}
+	}
+	return columns
+}
+
+func (m *MockExecutor) PrepareBatch(ctx context.Context, table string, columns []string) (Batch, error) {
+	if m.shouldError {
+		return nil, context.DeadlineExceeded
+	}
+	return &mockBatch{executor: m, insert: mockInsert{table: table, columns: columns, queryID: statementQueryID(ctx)}}, nil
+}
+
+// mockInsert is a batch sent to MockExecutor
+type mockInsert struct {
+	table   string
+	columns []string
+	queryID string
+	rows    [][]any
+}
+
+// mockBatch collects appended rows and records them in its executor on Send
+type mockBatch struct {
+	executor *MockExecutor
+	insert   mockInsert
+}
+
+func (b *mockBatch) Append(values ...any) error {
+	b.insert.rows = append(b.insert.rows, append([]any(nil), values...))
+	return nil
+}
+
+func (b *mockBatch) Send() error {
+	b.executor.mu.Lock()
+	defer b.executor.mu.Unlock()
+	b.executor.inserts = append(b.executor.inserts, b.insert)
+	return nil
+}
+
+func (b *mockBatch) Abort() error {
+	return nil
+}
+
+func (m *MockExecutor) KillQuery(ctx context.Context, queryID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.killedQueries = append(m.killedQueries, queryID)
+	return nil
+}
+
 func (m *MockExecutor) Close() error {
 	return nil
 }
@@ -824,6 +918,113 @@ func TestParseMigrationInfoChecksumChanges(t *testing.T) {
 	}
 }
 
+func TestParseMigrationInfoSettingsAndTimeout(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "backfill.sql", `-- version: 3.0.0
+-- description: Backfill
+-- setting: max_execution_time=3600
+-- setting: mutations_sync = 2
+-- timeout: 30m
+ALTER TABLE t UPDATE x = 1 WHERE 1;
+`)
+
+	info, err := parseMigrationInfo(path)
+	if err != nil {
+		t.Fatalf("parseMigrationInfo failed: %v", err)
+	}
+	expected := map[string]string{"max_execution_time": "3600", "mutations_sync": "2"}
+	if !reflect.DeepEqual(info.Settings, expected) {
+		t.Errorf("expected settings %v, got %v", expected, info.Settings)
+	}
+	if info.Timeout != 30*time.Minute {
+		t.Errorf("expected timeout 30m, got %v", info.Timeout)
+	}
+}
+
+func TestParseMigrationInfoLongHeader(t *testing.T) {
+	header := "-- version: 3.0.1\n"
+	for i := 0; i < 12; i++ {
+		header += fmt.Sprintf("-- setting: s%d=%d\n", i, i)
+	}
+	path := writeTestFile(t, t.TempDir(), "long.sql", header+"SELECT 1;\n-- setting: after_sql=1\n")
+
+	info, err := parseMigrationInfo(path)
+	if err != nil {
+		t.Fatalf("parseMigrationInfo failed: %v", err)
+	}
+	if len(info.Settings) != 12 {
+		t.Errorf("expected headers in a leading comment block past line 10 to be read, got %v", info.Settings)
+	}
+}
+
+func TestParseMigrationInfoInvalidHeaders(t *testing.T) {
+	for _, header := range []string{"-- setting: max_threads", "-- timeout: soon", "-- timeout: -5m"} {
+		path := writeTestFile(t, t.TempDir(), "bad.sql", header+"\nSELECT 1;\n")
+		if _, err := parseMigrationInfo(path); err == nil {
+			t.Errorf("expected error for header %q", header)
+		}
+	}
+}
+
+// contextExecutor records the settings and deadline of every Execute call
+type contextExecutor struct {
+	MockExecutor
+	settings  []map[string]string
+	deadlines []bool
+	block     bool // Wait for the context to end
+}
+
+func (m *contextExecutor) Execute(ctx context.Context, sql string) error {
+	m.settings = append(m.settings, statementSettings(ctx))
+	_, hasDeadline := ctx.Deadline()
+	m.deadlines = append(m.deadlines, hasDeadline)
+	if m.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+func TestExecuteSQLWithWriterSettingsAndTimeout(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "backfill.sql", "SELECT 1;\nSELECT 2;\n")
+	info := MigrationInfo{Path: path, Settings: map[string]string{"mutations_sync": "2"}, Timeout: time.Minute}
+	mock := &contextExecutor{}
+
+	if _, err := executeSQLWithWriter(ctxbg, mock, info, sqlSource{}, retryPolicy{}, testLogger(io.Discard)); err != nil {
+		t.Fatalf("executeSQLWithWriter failed: %v", err)
+	}
+	if len(mock.settings) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(mock.settings))
+	}
+	for i := range mock.settings {
+		if mock.settings[i]["mutations_sync"] != "2" || !mock.deadlines[i] {
+			t.Errorf("statement %d: expected settings and deadline, got %v / %v", i, mock.settings[i], mock.deadlines[i])
+		}
+	}
+}
+
+func TestExecuteSQLWithWriterTimeout(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "slow.sql", "SELECT sleep(3);\n")
+	info := MigrationInfo{Path: path, Timeout: 10 * time.Millisecond}
+	mock := &contextExecutor{block: true}
+
+	_, err := executeSQLWithWriter(ctxbg, mock, info, sqlSource{}, retryPolicy{}, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "statement 1 exceeded the 10ms timeout") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+}
+
+func TestExecuteSQLWithWriterNoSettings(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "plain.sql", "SELECT 1;\n")
+	mock := &contextExecutor{}
+
+	if _, err := executeSQLWithWriter(ctxbg, mock, MigrationInfo{Path: path}, sqlSource{}, retryPolicy{}, testLogger(io.Discard)); err != nil {
+		t.Fatalf("executeSQLWithWriter failed: %v", err)
+	}
+	if len(mock.settings[0]) != 1 || mock.settings[0]["log_comment"] == "" || mock.deadlines[0] {
+		t.Errorf("expected only log_comment and no deadline, got %v / %v", mock.settings[0], mock.deadlines[0])
+	}
+}
+
 // ============================================================================
 // Tests for escapeSQLString
 // ============================================================================
@@ -899,7 +1100,7 @@ func TestApplyDefaultsWithConfigClickHouseDefaults(t *testing.T) {
 }
 
 // ============================================================================
-// Tests for loadCSVData and loadCSVFile
+// Tests for loadData and loadDataFile
 // ============================================================================
 
 func TestLoadCSVFileWithWriter(t *testing.T) {
@@ -914,34 +1115,102 @@ func TestLoadCSVFileWithWriter(t *testing.T) {
 		t.Fatalf("failed to create test CSV: %v", err)
 	}
 
-	mock := &MockExecutor{}
+	mock := &MockExecutor{tables: map[string][]tableColumn{
+		"test_table": {{Name: "id", Type: "UInt32"}, {Name: "name", Type: "String"}, {Name: "value", Type: "Nullable(Float64)"}},
+	}}
 	var stdout bytes.Buffer
 
-	rows, err := loadCSVFileWithWriter(mock, csvFile, "test_table", &stdout, false)
+	rows, err := loadDataFileWithWriter(ctxbg, mock, csvFile, filepath.Base(csvFile), csvFileName("test_table"), dataLoadOptions{}, testLogger(&stdout))
 	if err != nil {
-		t.Fatalf("loadCSVFileWithWriter failed: %v", err)
+		t.Fatalf("loadDataFileWithWriter failed: %v", err)
 	}
 
 	if rows != 2 {
 		t.Errorf("expected 2 rows loaded, got %d", rows)
 	}
 
-	if len(mock.executedSQL) != 1 {
-		t.Errorf("expected 1 SQL execution, got %d", len(mock.executedSQL))
+	if len(mock.inserts) != 1 {
+		t.Fatalf("expected 1 batch insert, got %d", len(mock.inserts))
 	}
 
-	sql := mock.executedSQL[0]
-	if !strings.Contains(sql, "INSERT INTO test_table") {
-		t.Errorf("expected INSERT statement, got %q", sql)
+	insert := mock.inserts[0]
+	if insert.table != "test_table" {
+		t.Errorf("expected insert into test_table, got %q", insert.table)
 	}
-	if !strings.Contains(sql, "id, name, value") {
-		t.Errorf("expected column names, got %q", sql)
+	if !reflect.DeepEqual(insert.columns, []string{"id", "name", "value"}) {
+		t.Errorf("expected column names, got %v", insert.columns)
 	}
-	if !strings.Contains(sql, "'1'") && !strings.Contains(sql, "'foo'") {
-		t.Errorf("expected values, got %q", sql)
+	expected := [][]any{{uint32(1), "foo", float64(100)}, {uint32(2), "bar", float64(200)}}
+	if !reflect.DeepEqual(insert.rows, expected) {
+		t.Errorf("expected rows %v, got %v", expected, insert.rows)
 	}
 }
 
+func TestLoadCSVFileBatches(t *testing.T) {
+	csvFile := writeTestFile(t, t.TempDir(), "events.csv", "id\n1\n2\n3\n4\n5\n")
+	mock := &MockExecutor{tables: map[string][]tableColumn{"events": stringColumns("id")}}
+
+	rows, err := loadDataFileWithWriter(withRunID(ctxbg, "run1"), mock, csvFile, filepath.Base(csvFile), csvFileName("events"), dataLoadOptions{batchSize: 2}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataFileWithWriter failed: %v", err)
+	}
+	if rows != 5 {
+		t.Errorf("expected 5 rows loaded, got %d", rows)
+	}
+
+	var sizes, queryIDs []string
+	for _, insert := range mock.inserts {
+		sizes = append(sizes, fmt.Sprint(len(insert.rows)))
+		queryIDs = append(queryIDs, insert.queryID)
+	}
+	if strings.Join(sizes, ",") != "2,2,1" {
+		t.Errorf("expected batches of 2, 2 and 1 rows, got %v", sizes)
+	}
+	if strings.Join(queryIDs, ",") != "run1-data-events.csv-1,run1-data-events.csv-2,run1-data-events.csv-3" {
+		t.Errorf("expected a query ID per batch, got %v", queryIDs)
+	}
+}
+
+func TestLoadCSVFileColumnCountMismatch(t *testing.T) {
+	csvFile := writeTestFile(t, t.TempDir(), "events.csv", "id,name\n1,foo\n2\n")
+
+	mock := &MockExecutor{tables: map[string][]tableColumn{"events": stringColumns("id", "name")}}
+
+	_, err := loadDataFileWithWriter(ctxbg, mock, csvFile, filepath.Base(csvFile), csvFileName("events"), dataLoadOptions{}, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "line 3 has 1 columns, expected 2") {
+		t.Errorf("expected a column count error with the line, got %v", err)
+	}
+}
+
+func TestLoadCSVFileConversionError(t *testing.T) {
+	csvFile := writeTestFile(t, t.TempDir(), "orders.csv", "id,price\n1,9.99\n2,\"12,50\"\n")
+	mock := &MockExecutor{tables: map[string][]tableColumn{
+		"orders": {{Name: "id", Type: "UInt64"}, {Name: "price", Type: "Decimal(10, 2)"}},
+	}}
+
+	rows, err := loadDataFileWithWriter(ctxbg, mock, csvFile, filepath.Base(csvFile), csvFileName("orders"), dataLoadOptions{nullValue: defaultNullValue}, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), `line 3, column price: "12,50" is not a valid Decimal(10, 2)`) {
+		t.Errorf("expected a conversion error with the line and column, got %v", err)
+	}
+	if rows != 0 || len(mock.inserts) != 0 {
+		t.Errorf("expected nothing loaded, got %d rows in %d inserts", rows, len(mock.inserts))
+	}
+}
+
+func TestLoadCSVFileUnknownTable(t *testing.T) {
+	csvFile := writeTestFile(t, t.TempDir(), "missing.csv", "id\n1\n")
+
+	_, err := loadDataFileWithWriter(ctxbg, &MockExecutor{}, csvFile, filepath.Base(csvFile), csvFileName("missing"), dataLoadOptions{}, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "failed to describe table missing") {
+		t.Errorf("expected a describe error, got %v", err)
+	}
+}
+
+// csvFileName is the dataFileName of table.csv
+func csvFileName(table string) dataFileName {
+	return dataFileName{Table: table, Format: formatCSV}
+}
+
 func TestLoadCSVFileEmptyData(t *testing.T) {
 	tmpDir := t.TempDir()
 	csvFile := filepath.Join(tmpDir, "test.csv")
@@ -951,21 +1220,21 @@ func TestLoadCSVFileEmptyData(t *testing.T) {
 		t.Fatalf("failed to create test CSV: %v", err)
 	}
 
-	mock := &MockExecutor{}
+	mock := &MockExecutor{tables: map[string][]tableColumn{"test_table": stringColumns("id", "name", "value")}}
 	var stdout bytes.Buffer
 
-	rows, err := loadCSVFileWithWriter(mock, csvFile, "test_table", &stdout, false)
+	rows, err := loadDataFileWithWriter(ctxbg, mock, csvFile, filepath.Base(csvFile), csvFileName("test_table"), dataLoadOptions{}, testLogger(&stdout))
 	if err != nil {
-		t.Fatalf("loadCSVFileWithWriter failed: %v", err)
+		t.Fatalf("loadDataFileWithWriter failed: %v", err)
 	}
 
 	if rows != 0 {
 		t.Errorf("expected 0 rows for empty data, got %d", rows)
 	}
 
-	// No SQL should be executed for empty data
-	if len(mock.executedSQL) != 0 {
-		t.Errorf("expected 0 SQL executions for empty data, got %d", len(mock.executedSQL))
+	// Nothing should be inserted for empty data
+	if len(mock.inserts) != 0 {
+		t.Errorf("expected no inserts for empty data, got %d", len(mock.inserts))
 	}
 }
 
@@ -973,7 +1242,7 @@ func TestLoadCSVFileNotFound(t *testing.T) {
 	mock := &MockExecutor{}
 	var stdout bytes.Buffer
 
-	_, err := loadCSVFileWithWriter(mock, "/nonexistent/file.csv", "table", &stdout, false)
+	_, err := loadDataFileWithWriter(ctxbg, mock, "/nonexistent/file.csv", "file.csv", csvFileName("table"), dataLoadOptions{}, testLogger(&stdout))
 	if err == nil {
 		t.Error("expected error for nonexistent file")
 	}
@@ -990,18 +1259,17 @@ func TestLoadCSVFileWithQuotes(t *testing.T) {
 		t.Fatalf("failed to create test CSV: %v", err)
 	}
 
-	mock := &MockExecutor{}
+	mock := &MockExecutor{tables: map[string][]tableColumn{"test_table": stringColumns("id", "name")}}
 	var stdout bytes.Buffer
 
-	_, err := loadCSVFileWithWriter(mock, csvFile, "test_table", &stdout, false)
+	_, err := loadDataFileWithWriter(ctxbg, mock, csvFile, filepath.Base(csvFile), csvFileName("test_table"), dataLoadOptions{}, testLogger(&stdout))
 	if err != nil {
-		t.Fatalf("loadCSVFileWithWriter failed: %v", err)
+		t.Fatalf("loadDataFileWithWriter failed: %v", err)
 	}
 
-	sql := mock.executedSQL[0]
-	// Single quotes should be escaped
-	if !strings.Contains(sql, "it''s quoted") {
-		t.Errorf("expected escaped quotes, got %q", sql)
+	// Values are sent as they are, without SQL quoting
+	if got := mock.inserts[0].rows[0][1]; got != "it's quoted" {
+		t.Errorf("expected the value unchanged, got %q", got)
 	}
 }
 
@@ -1019,16 +1287,19 @@ func TestLoadCSVDataWithWriter(t *testing.T) {
 		t.Fatalf("failed to create CSV2: %v", err)
 	}
 
-	mock := &MockExecutor{}
+	mock := &MockExecutor{tables: map[string][]tableColumn{
+		"table1": stringColumns("id", "name"),
+		"table2": stringColumns("id", "value"),
+	}}
 	var stdout bytes.Buffer
 
-	err := loadCSVDataWithWriter(mock, tmpDir, &stdout, false)
+	_, err := loadDataWithWriter(ctxbg, mock, tmpDir, dataLoadOptions{}, testLogger(&stdout))
 	if err != nil {
-		t.Fatalf("loadCSVDataWithWriter failed: %v", err)
+		t.Fatalf("loadDataWithWriter failed: %v", err)
 	}
 
-	if len(mock.executedSQL) != 2 {
-		t.Errorf("expected 2 SQL executions, got %d", len(mock.executedSQL))
+	if len(mock.inserts) != 2 {
+		t.Errorf("expected 2 batch inserts, got %d", len(mock.inserts))
 	}
 }
 
@@ -1038,14 +1309,14 @@ func TestLoadCSVDataEmptyDirectory(t *testing.T) {
 	mock := &MockExecutor{}
 	var stdout bytes.Buffer
 
-	err := loadCSVDataWithWriter(mock, tmpDir, &stdout, false)
+	_, err := loadDataWithWriter(ctxbg, mock, tmpDir, dataLoadOptions{}, testLogger(&stdout))
 	if err != nil {
-		t.Fatalf("loadCSVDataWithWriter failed: %v", err)
+		t.Fatalf("loadDataWithWriter failed: %v", err)
 	}
 
 	output := stdout.String()
-	if !strings.Contains(output, "No CSV files found") {
-		t.Errorf("expected 'No CSV files found' message, got %q", output)
+	if !strings.Contains(output, "No data files found") {
+		t.Errorf("expected 'No data files found' message, got %q", output)
 	}
 }
 
@@ -1053,12 +1324,164 @@ func TestLoadCSVDataDirectoryNotFound(t *testing.T) {
 	mock := &MockExecutor{}
 	var stdout bytes.Buffer
 
-	err := loadCSVDataWithWriter(mock, "/nonexistent/directory", &stdout, false)
+	_, err := loadDataWithWriter(ctxbg, mock, "/nonexistent/directory", dataLoadOptions{}, testLogger(&stdout))
 	if err == nil {
 		t.Error("expected error for nonexistent directory")
 	}
 }
 
+// dataEntryTables returns the file and table of each entry as "file=table"
+func dataEntryTables(entries []dataEntry) []string {
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.File+"="+e.Name.Table)
+	}
+	return got
+}
+
+func TestCollectDataFilesDatabaseFolders(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id\n")
+	writeTestFile(t, dir, "accounts.tsv", "id\n")
+	writeTestFile(t, dir, "analytics/events.csv", "id\n")
+	writeTestFile(t, dir, "analytics/notes.txt", "not data")
+	writeTestFile(t, dir, "@dev/users.csv", "id\n")
+	writeTestFile(t, dir, "@dev/analytics/events.ndjson", "{}\n")
+	writeTestFile(t, dir, "@prod/users.csv", "id\n")
+	writeTestFile(t, dir, ".cache/users.csv", "id\n")
+
+	entries, err := collectDataFiles(dir, indexContext{Env: "dev"}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("collectDataFiles failed: %v", err)
+	}
+	want := []string{
+		"accounts.tsv=accounts",
+		"users.csv=users",
+		"analytics/events.csv=analytics.events",
+		"@dev/users.csv=users",
+		"@dev/analytics/events.ndjson=analytics.events",
+	}
+	if got := dataEntryTables(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	// Without an environment no @<env> folder is loaded
+	entries, err = collectDataFiles(dir, indexContext{}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("collectDataFiles failed: %v", err)
+	}
+	if got := dataEntryTables(entries); !reflect.DeepEqual(got, want[:3]) {
+		t.Errorf("expected %v, got %v", want[:3], got)
+	}
+}
+
+func TestCollectDataFilesDataList(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "users.csv", "id\n")
+	writeTestFile(t, dir, "accounts.csv", "id\n")
+	writeTestFile(t, dir, "analytics/events.csv", "id\n")
+	writeTestFile(t, dir, "@dev/users.csv", "id\n")
+	writeTestFile(t, dir, "data.lst", `# Accounts before the users referring to them
+accounts.csv
+users.csv
+@if env=dev
+./@dev/users.csv
+@endif
+@include-dir analytics
+`)
+
+	entries, err := collectDataFiles(dir, indexContext{Env: "dev"}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("collectDataFiles failed: %v", err)
+	}
+	want := []string{
+		"accounts.csv=accounts",
+		"users.csv=users",
+		"@dev/users.csv=users",
+		"analytics/events.csv=analytics.events",
+	}
+	if got := dataEntryTables(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	entries, err = collectDataFiles(dir, indexContext{Env: "prod"}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("collectDataFiles failed: %v", err)
+	}
+	want = []string{"accounts.csv=accounts", "users.csv=users", "analytics/events.csv=analytics.events"}
+	if got := dataEntryTables(entries); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestCollectDataFilesInvalidPaths(t *testing.T) {
+	tests := []struct {
+		name    string
+		list    string
+		wantErr string
+	}{
+		{"nested too deeply", "analytics/2024/events.csv", "nested too deeply"},
+		{"outside the data directory", "../users.csv", "outside the data directory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "data")
+			writeTestFile(t, dir, "data.lst", tt.list+"\n")
+
+			_, err := collectDataFiles(dir, indexContext{}, testLogger(io.Discard))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("expected error containing %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestLoadDataDatabaseFolder(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "analytics/events.csv", "id,name\n1,foo\n")
+
+	mock := &MockExecutor{tables: map[string][]tableColumn{"analytics.events": stringColumns("id", "name")}}
+	loaded, err := loadDataWithWriter(ctxbg, mock, dir, dataLoadOptions{}, testLogger(io.Discard))
+	if err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+	if len(loaded) != 1 || loaded[0].File != "analytics/events.csv" || loaded[0].Table != "analytics.events" {
+		t.Fatalf("expected analytics/events.csv loaded into analytics.events, got %+v", loaded)
+	}
+	if len(mock.inserts) != 1 || !strings.HasPrefix(mock.inserts[0].table, "analytics.dbmigrate_stage_analytics_events_") {
+		t.Errorf("expected the file staged in the analytics database, got %+v", mock.inserts)
+	}
+	if len(statementsContaining(mock.executedSQL, "INSERT INTO analytics.events SELECT * FROM analytics.dbmigrate_stage_")) != 1 {
+		t.Errorf("expected the staged rows copied to analytics.events, got %v", mock.executedSQL)
+	}
+	records := statementsContaining(mock.executedSQL, "INSERT INTO data_versions")
+	if len(records) != 1 || !strings.Contains(records[0], "'analytics/events.csv', 'analytics.events'") {
+		t.Errorf("expected analytics/events.csv recorded, got %v", records)
+	}
+}
+
+func TestLoadDataQueryIDsPerFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "events.csv", "id\n1\n")
+	writeTestFile(t, dir, "events.tsv", "id\n2\n")
+	writeTestFile(t, dir, "@dev/events.csv", "id\n3\n")
+
+	mock := &MockExecutor{tables: map[string][]tableColumn{"events": stringColumns("id")}}
+	opts := dataLoadOptions{index: indexContext{Env: "dev"}}
+	if _, err := loadDataWithWriter(withRunID(ctxbg, "run1"), mock, dir, opts, testLogger(io.Discard)); err != nil {
+		t.Fatalf("loadDataWithWriter failed: %v", err)
+	}
+
+	var queryIDs []string
+	for _, insert := range mock.inserts {
+		queryIDs = append(queryIDs, insert.queryID)
+	}
+	want := []string{"run1-data-events.csv-1", "run1-data-events.tsv-1", "run1-data-@dev/events.csv-1"}
+	if !reflect.DeepEqual(queryIDs, want) {
+		t.Errorf("expected a query ID per file, got %v", queryIDs)
+	}
+}
+
 // ============================================================================
 // Tests for showSchemaVersionWithWriter
 // ============================================================================
@@ -1257,3 +1680,357 @@ func TestMigrationInfoStruct(t *testing.T) {
 		t.Error("Checksum not set correctly")
 	}
 }
+
+// ============================================================================
+// Tests for -target and -steps
+// ============================================================================
+
+// writeMigrationTree creates numbered SQL files with version headers and an index.lst listing them
+func writeMigrationTree(t *testing.T, versions ...string) string {
+	t.Helper()
+	tmpDir := t.TempDir()
+
+	var index strings.Builder
+	for i, version := range versions {
+		name := fmt.Sprintf("%03d.sql", i+1)
+		content := fmt.Sprintf("-- version: %s\n-- description: Migration %s\nCREATE TABLE t%d (id INT);\n", version, version, i+1)
+		if err := os.WriteFile(filepath.Join(tmpDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to create %s: %v", name, err)
+		}
+		index.WriteString(name + "\n")
+	}
+
+	indexPath := filepath.Join(tmpDir, "index.lst")
+	if err := os.WriteFile(indexPath, []byte(index.String()), 0644); err != nil {
+		t.Fatalf("failed to create index.lst: %v", err)
+	}
+	return indexPath
+}
+
+// writeTestFile creates a file below dir, creating parent directories as needed
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create directory for %s: %v", name, err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to create %s: %v", name, err)
+	}
+	return path
+}
+
+// migrationStatements filters out the bookkeeping inserts into schema_versions
+func migrationStatements(executed []string) []string {
+	var result []string
+	for _, sql := range executed {
+		if !strings.HasPrefix(sql, "INSERT INTO schema_versions") {
+			result = append(result, sql)
+		}
+	}
+	return result
+}
+
+func TestMigrationLimit(t *testing.T) {
+	migrations := []MigrationInfo{
+		{Version: "1.0.0"},
+		{Version: ""},
+		{Version: "1.0.1"},
+		{Version: "1.0.2"},
+	}
+
+	tests := []struct {
+		target   string
+		expected int
+	}{
+		{"", 4},
+		{"1.0.0", 1},
+		{"1.0.1", 3},
+		{"1.0.2", 4},
+	}
+
+	for _, tt := range tests {
+		limit, err := migrationLimit(migrations, tt.target)
+		if err != nil {
+			t.Errorf("migrationLimit(%q) failed: %v", tt.target, err)
+			continue
+		}
+		if limit != tt.expected {
+			t.Errorf("migrationLimit(%q) = %d, expected %d", tt.target, limit, tt.expected)
+		}
+	}
+}
+
+func TestMigrationLimitUnknownTarget(t *testing.T) {
+	_, err := migrationLimit([]MigrationInfo{{Version: "1.0.0"}}, "9.9.9")
+	if err == nil {
+		t.Fatal("expected error for unknown target version")
+	}
+	if !strings.Contains(err.Error(), "9.9.9") {
+		t.Errorf("expected target version in error, got %q", err)
+	}
+}
+
+func TestParseFlagsTargetAndSteps(t *testing.T) {
+	var stderr bytes.Buffer
+
+	cfg := DefaultRunConfig()
+	cfg.Stderr = &stderr
+
+	_, err := parseFlags([]string{"-target", "2.0.5", "-steps", "3"}, &cfg)
+	if err != nil {
+		t.Fatalf("parseFlags failed: %v", err)
+	}
+
+	if cfg.Target != "2.0.5" {
+		t.Errorf("expected Target '2.0.5', got %q", cfg.Target)
+	}
+	if cfg.Steps != 3 {
+		t.Errorf("expected Steps 3, got %d", cfg.Steps)
+	}
+}
+
+func TestRunTarget(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0", "1.0.1", "1.0.2")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-target", "1.0.1"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	executed := migrationStatements(mock.executedSQL)
+	if len(executed) != 2 {
+		t.Fatalf("expected 2 migrations applied, got %d: %v", len(executed), executed)
+	}
+	if strings.Contains(strings.Join(executed, "\n"), "t3") {
+		t.Error("migration after target should not be applied")
+	}
+}
+
+func TestRunTargetNotFound(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-target", "2.0.0"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+	if len(mock.executedSQL) != 0 {
+		t.Errorf("expected nothing to be executed, got %v", mock.executedSQL)
+	}
+	if !strings.Contains(stderr.String(), "target version 2.0.0 not found") {
+		t.Errorf("expected target error, got %q", stderr.String())
+	}
+}
+
+func TestRunSteps(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0", "1.0.1", "1.0.2")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutorWithRows{
+		rows: []map[string]interface{}{},
+	}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-steps", "1"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	executed := migrationStatements(mock.executedSQL)
+	if len(executed) != 1 {
+		t.Fatalf("expected 1 migration applied, got %d: %v", len(executed), executed)
+	}
+	if !strings.Contains(stdout.String(), "2 file(s) not considered") {
+		t.Errorf("expected remaining files in summary, got %q", stdout.String())
+	}
+}
+
+func TestRunStepsIgnoresAlreadyApplied(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0", "1.0.1", "1.0.2")
+	info, err := parseMigrationInfo(filepath.Join(filepath.Dir(indexPath), "001.sql"))
+	if err != nil {
+		t.Fatalf("parseMigrationInfo failed: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutorWithRows{
+		rows: []map[string]interface{}{
+			{"version": "1.0.0", "checksum": info.Checksum},
+		},
+	}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-steps", "1"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	executed := migrationStatements(mock.executedSQL)
+	if len(executed) != 1 || !strings.Contains(executed[0], "t2") {
+		t.Errorf("expected only the first pending migration to be applied, got %v", executed)
+	}
+}
+
+func TestRunNegativeSteps(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-steps", "-1"},
+		Executor: &MockExecutor{},
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+}
+
+// ============================================================================
+// Tests for getMigrationRecords and versionTracker
+// ============================================================================
+
+func TestGetAppliedMigrationsIgnoresFailed(t *testing.T) {
+	mock := &MockExecutorWithRows{
+		rows: []map[string]interface{}{
+			{"version": "1.0.0", "checksum": "abc123", "status": "applied"},
+			{"version": "1.1.0", "checksum": "def456", "status": "failed"},
+		},
+	}
+
+	migrations, err := getAppliedMigrations(mock)
+	if err != nil {
+		t.Fatalf("getAppliedMigrations failed: %v", err)
+	}
+
+	if _, exists := migrations["1.1.0"]; exists {
+		t.Error("failed migration should not be reported as applied")
+	}
+	if migrations["1.0.0"] != "abc123" {
+		t.Errorf("expected checksum 'abc123' for version 1.0.0, got %q", migrations["1.0.0"])
+	}
+}
+
+func TestGetMigrationRecords(t *testing.T) {
+	mock := &MockExecutorWithRows{
+		rows: []map[string]interface{}{
+			{"version": "1.0.0", "checksum": "abc123", "filename": "001.sql", "duration_ms": uint64(1500)},
+			{"version": "", "checksum": "ignored"},
+		},
+	}
+
+	records, err := getMigrationRecords(mock)
+	if err != nil {
+		t.Fatalf("getMigrationRecords failed: %v", err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	if records[0].Status != statusApplied {
+		t.Errorf("expected rows without status to be applied, got %q", records[0].Status)
+	}
+	if records[0].Duration != 1500*time.Millisecond {
+		t.Errorf("expected duration 1.5s, got %v", records[0].Duration)
+	}
+}
+
+func TestVersionTrackerLegacyTable(t *testing.T) {
+	mock := &MockExecutor{}
+	tracker := &versionTracker{executor: mock}
+	info := MigrationInfo{Version: "1.0.0", Filename: "001.sql", Checksum: "abc123"}
+
+	if err := tracker.record(info, statusApplied, time.Second); err != nil {
+		t.Fatalf("record failed: %v", err)
+	}
+	if len(mock.executedSQL) != 1 || strings.Contains(mock.executedSQL[0], "duration_ms") {
+		t.Errorf("expected legacy insert, got %v", mock.executedSQL)
+	}
+
+	if err := tracker.record(info, statusFailed, time.Second); err == nil {
+		t.Error("expected error recording a failure without a status column")
+	}
+}
+
+// countingExecutor counts the queries answered by MockExecutorWithRows
+type countingExecutor struct {
+	MockExecutorWithRows
+	queries int
+}
+
+func (m *countingExecutor) Query(ctx context.Context, sql string) ([]map[string]interface{}, error) {
+	m.queries++
+	return m.MockExecutorWithRows.Query(ctx, sql)
+}
+
+func TestVersionTrackerNoticesAddedColumns(t *testing.T) {
+	mock := &countingExecutor{}
+	mock.rows = []map[string]interface{}{{"name": "version"}, {"name": "checksum"}}
+	tracker := &versionTracker{executor: mock}
+	info := MigrationInfo{Version: "1.0.0", Filename: "001.sql", Checksum: "abc123"}
+
+	if err := tracker.record(info, statusApplied, time.Second); err != nil {
+		t.Fatalf("record failed: %v", err)
+	}
+
+	// A later migration of the same run adds the columns, as sample/schema_versions_status.sql does
+	mock.rows = append(mock.rows, map[string]interface{}{"name": "status"}, map[string]interface{}{"name": "duration_ms"})
+	for i := 0; i < 3; i++ {
+		if err := tracker.record(info, statusFailed, time.Second); err != nil {
+			t.Fatalf("expected failures recorded once the columns exist: %v", err)
+		}
+	}
+	if mock.queries != 2 {
+		t.Errorf("expected the columns looked up until they were found, got %d queries", mock.queries)
+	}
+	if last := mock.executedSQL[len(mock.executedSQL)-1]; !strings.Contains(last, "'failed', 1000") {
+		t.Errorf("expected an extended insert, got %q", last)
+	}
+}
+
+func TestVersionTrackerExtendedTable(t *testing.T) {
+	mock := &MockExecutorWithRows{
+		rows: []map[string]interface{}{
+			{"name": "version"},
+			{"name": "status"},
+			{"name": "duration_ms"},
+		},
+	}
+	tracker := &versionTracker{executor: mock}
+	info := MigrationInfo{Version: "1.0.0", Filename: "001.sql", Checksum: "abc123"}
+
+	if err := tracker.record(info, statusFailed, 1500*time.Millisecond); err != nil {
+		t.Fatalf("record failed: %v", err)
+	}
+
+	if len(mock.executedSQL) != 1 {
+		t.Fatalf("expected 1 SQL execution, got %d", len(mock.executedSQL))
+	}
+	sql := mock.executedSQL[0]
+	if !strings.Contains(sql, "'failed', 1500") {
+		t.Errorf("expected status and duration in insert, got %q", sql)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pushTimeout bounds the request to -metrics-push-url
+const pushTimeout = 10 * time.Second
+
+// lastSuccessMetric keeps its value from earlier runs when a run fails
+const lastSuccessMetric = "dbmigrate_last_success_timestamp_seconds"
+
+// metricSet builds a document in the Prometheus text exposition format
+type metricSet struct {
+	buf    bytes.Buffer
+	labels string // Labels on every sample, e.g. database="analytics"
+}
+
+// header writes the HELP and TYPE lines of a gauge
+func (m *metricSet) header(name, help string) {
+	fmt.Fprintf(&m.buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// sample writes one value of name with the common labels and the given label pairs
+func (m *metricSet) sample(name string, value float64, labelPairs ...string) {
+	labels := []string{m.labels}
+	for i := 0; i+1 < len(labelPairs); i += 2 {
+		labels = append(labels, labelPairs[i]+"="+escapeLabel(labelPairs[i+1]))
+	}
+	fmt.Fprintf(&m.buf, "%s{%s} %s\n", name, strings.Join(labels, ","), strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// gauge writes a gauge with a single value
+func (m *metricSet) gauge(name, help string, value float64) {
+	m.header(name, help)
+	m.sample(name, value)
+}
+
+// labelEscaper escapes label values as the text format expects
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel returns value as a quoted label value
+func escapeLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+// buildMetrics returns the metrics of a migrate run. lastSuccess is the time of the
+// last successful run, omitted when zero.
+func buildMetrics(report *runReport, database string, success bool, finished, lastSuccess time.Time) []byte {
+	m := &metricSet{labels: "database=" + escapeLabel(database)}
+
+	migrate := report.Migrate
+	if migrate == nil {
+		migrate = &migrateReport{}
+	}
+	m.gauge("dbmigrate_migrations_applied", "Migrations applied by the last run.", float64(len(migrate.Applied)))
+	m.gauge("dbmigrate_migrations_skipped", "Migrations skipped as already applied by the last run.", float64(len(migrate.Skipped)))
+	m.gauge("dbmigrate_migrations_failed", "Migrations that failed or were interrupted in the last run.", float64(len(migrate.Failed)))
+	m.gauge("dbmigrate_migrations_excluded", "Migrations excluded by tags in the last run.", float64(len(migrate.Excluded)))
+	m.gauge("dbmigrate_statements_executed", "Statements executed by the last run.", float64(migrate.Statements))
+
+	m.header("dbmigrate_migration_duration_seconds", "Duration of each migration applied or failed in the last run.")
+	for _, f := range migrate.Applied {
+		m.sample("dbmigrate_migration_duration_seconds", float64(f.DurationMs)/1000, "file", f.File, "version", f.Version)
+	}
+	for _, f := range migrate.Failed {
+		m.sample("dbmigrate_migration_duration_seconds", float64(f.DurationMs)/1000, "file", f.File, "version", f.Version)
+	}
+
+	if report.Data != nil {
+		m.gauge("dbmigrate_data_rows_loaded_last_run", "Data file rows loaded by the last run.", float64(report.Data.Rows))
+		m.header("dbmigrate_data_rows_loaded", "Data file rows loaded into each table by the last run.")
+		for _, f := range report.Data.Files {
+			m.sample("dbmigrate_data_rows_loaded", float64(f.Rows), "file", f.File, "table", f.Table)
+		}
+	}
+
+	successValue := 0.0
+	if success {
+		successValue = 1
+	}
+	m.gauge("dbmigrate_last_run_success", "Whether the last run succeeded (1) or failed (0).", successValue)
+	m.gauge("dbmigrate_last_run_timestamp_seconds", "Time the last run finished.", float64(finished.Unix()))
+	if !lastSuccess.IsZero() {
+		m.gauge(lastSuccessMetric, "Time the last successful run finished.", float64(lastSuccess.Unix()))
+	}
+	return m.buf.Bytes()
+}
+
+// exportMetrics writes the metrics of a migrate run to -metrics-file and -metrics-push-url.
+// Failing to export them only produces a warning.
+func exportMetrics(cfg RunConfig, report *runReport, success bool, logger *Logger) {
+	finished := time.Now()
+	if cfg.MetricsFile != "" {
+		if err := writeMetricsFile(cfg.MetricsFile, report, cfg.Database, success, finished); err != nil {
+			logger.Warnf("%v", err)
+		}
+	}
+	if cfg.MetricsPushURL != "" {
+		if err := pushMetrics(cfg.MetricsPushURL, report, cfg.Database, success, finished); err != nil {
+			logger.Warnf("%v", err)
+		}
+	}
+}
+
+// writeMetricsFile writes metrics for the node_exporter textfile collector. The file
+// is replaced atomically so the collector never reads a partial file. When the run
+// failed, the last success time is carried over from the previous file.
+func writeMetricsFile(path string, report *runReport, database string, success bool, finished time.Time) error {
+	lastSuccess := finished
+	if !success {
+		lastSuccess = readLastSuccess(path)
+	}
+	data := buildMetrics(report, database, success, finished, lastSuccess)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics file: %w", err)
+	}
+	return nil
+}
+
+// readLastSuccess returns the last success time recorded in a previous metrics file, if any
+func readLastSuccess(path string) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, lastSuccessMetric+"{") {
+			continue
+		}
+		fields := strings.Fields(line)
+		seconds, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(int64(seconds), 0)
+	}
+	return time.Time{}
+}
+
+// pushGroupingLabel returns a label of a Pushgateway grouping key as a URL path. The
+// value is base64 encoded, so it may be empty or contain slashes.
+func pushGroupingLabel(name, value string) string {
+	if value == "" {
+		return name + "@base64/="
+	}
+	return name + "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// pushMetrics sends metrics to a Pushgateway under job "dbmigrate" and the database.
+// POST only replaces the metrics it sends, so a failed run leaves the previous last
+// success time in place.
+func pushMetrics(baseURL string, report *runReport, database string, success bool, finished time.Time) error {
+	var lastSuccess time.Time
+	if success {
+		lastSuccess = finished
+	}
+	data := buildMetrics(report, database, success, finished, lastSuccess)
+
+	endpoint := strings.TrimSuffix(baseURL, "/") + "/metrics/job/dbmigrate/" + pushGroupingLabel("database", database)
+	client := &http.Client{Timeout: pushTimeout}
+	resp, err := client.Post(endpoint, "text/plain; version=0.0.4", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to push metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("failed to push metrics: %s returned %s", endpoint, resp.Status)
+	}
+	return nil
+}
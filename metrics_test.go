@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildMetrics(t *testing.T) {
+	report := &runReport{
+		Migrate: &migrateReport{
+			Applied:    []appliedFile{{File: "auth.sql", Version: "2.0.2", Statements: 4, DurationMs: 1500}},
+			Skipped:    []string{"schema.sql", "users.sql"},
+			Failed:     []failedFile{{File: "events.sql", Version: "2.0.3", DurationMs: 250}},
+			Statements: 4,
+		},
+		Data: &dataReport{Files: []dataFile{{File: "users.csv", Table: "users", Rows: 120}}, Rows: 120},
+	}
+	finished := time.Unix(1700000000, 0)
+
+	metrics := string(buildMetrics(report, `an"alytics`, false, finished, time.Time{}))
+
+	for _, want := range []string{
+		"# TYPE dbmigrate_migrations_applied gauge\n",
+		`dbmigrate_migrations_applied{database="an\"alytics"} 1` + "\n",
+		`dbmigrate_migrations_skipped{database="an\"alytics"} 2` + "\n",
+		`dbmigrate_migrations_failed{database="an\"alytics"} 1` + "\n",
+		`dbmigrate_migration_duration_seconds{database="an\"alytics",file="auth.sql",version="2.0.2"} 1.5` + "\n",
+		`dbmigrate_migration_duration_seconds{database="an\"alytics",file="events.sql",version="2.0.3"} 0.25` + "\n",
+		`dbmigrate_data_rows_loaded{database="an\"alytics",file="users.csv",table="users"} 120` + "\n",
+		`dbmigrate_last_run_success{database="an\"alytics"} 0` + "\n",
+		`dbmigrate_last_run_timestamp_seconds{database="an\"alytics"} 1700000000` + "\n",
+	} {
+		if !strings.Contains(metrics, want) {
+			t.Errorf("expected metrics to contain %q, got:\n%s", want, metrics)
+		}
+	}
+	if strings.Contains(metrics, lastSuccessMetric) {
+		t.Errorf("expected no last success time without one, got:\n%s", metrics)
+	}
+}
+
+func TestWriteMetricsFileKeepsLastSuccess(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dbmigrate.prom")
+	report := &runReport{Migrate: &migrateReport{}}
+	succeeded := time.Unix(1700000000, 0)
+
+	if err := writeMetricsFile(path, report, "analytics", true, succeeded); err != nil {
+		t.Fatalf("writeMetricsFile failed: %v", err)
+	}
+	if err := writeMetricsFile(path, report, "analytics", false, succeeded.Add(time.Hour)); err != nil {
+		t.Fatalf("writeMetricsFile failed: %v", err)
+	}
+
+	if got := readLastSuccess(path); !got.Equal(succeeded) {
+		t.Errorf("expected the failed run to keep the last success time %v, got %v", succeeded, got)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), `dbmigrate_last_run_success{database="analytics"} 0`) {
+		t.Errorf("expected the failed run to be recorded, got:\n%s", data)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("expected no temporary files left, got %d entries", len(entries))
+	}
+}
+
+func TestPushGroupingLabel(t *testing.T) {
+	tests := map[string]string{
+		"analytics": "database@base64/YW5hbHl0aWNz",
+		"":          "database@base64/=",
+		"a/b":       "database@base64/YS9i",
+	}
+	for value, want := range tests {
+		if got := pushGroupingLabel("database", value); got != want {
+			t.Errorf("pushGroupingLabel(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestRunMetricsFileAndPush(t *testing.T) {
+	var pushedPath, pushedBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushedPath, pushedBody = r.Method+" "+r.URL.Path, string(body)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+	metricsPath := filepath.Join(dir, "dbmigrate.prom")
+
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-db", "analytics", "-metrics-file", metricsPath, "-metrics-push-url", server.URL},
+		Executor: &interruptExecutor{},
+	}
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	data, err := os.ReadFile(metricsPath)
+	if err != nil {
+		t.Fatalf("expected a metrics file: %v", err)
+	}
+	for _, want := range []string{`dbmigrate_migrations_applied{database="analytics"} 1`, `dbmigrate_last_run_success{database="analytics"} 1`, lastSuccessMetric} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected metrics file to contain %q, got:\n%s", want, data)
+		}
+	}
+	if pushedPath != "POST /metrics/job/dbmigrate/database@base64/YW5hbHl0aWNz" || pushedBody != string(data) {
+		t.Errorf("expected the same metrics pushed to the Pushgateway, got %s:\n%s", pushedPath, pushedBody)
+	}
+}
+
+func TestRunMetricsOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+	metricsPath := filepath.Join(dir, "dbmigrate.prom")
+
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-db", "analytics", "-metrics-file", metricsPath},
+		Executor: &flakyExecutor{failures: 10, err: errors.New("syntax error")},
+	}
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+
+	data, _ := os.ReadFile(metricsPath)
+	if !strings.Contains(string(data), `dbmigrate_last_run_success{database="analytics"} 0`) {
+		t.Errorf("expected a failed run in the metrics file, got:\n%s", data)
+	}
+}
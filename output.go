@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Values of the -output flag
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// runReport is the document written to stdout with -output json.
+// Exactly one of the command sections is set, matching Command.
+type runReport struct {
+	Command string         `json:"command"`
+	RunID   string         `json:"run_id"`
+	Success bool           `json:"success"`
+	Error   string         `json:"error,omitempty"`
+	Migrate *migrateReport `json:"migrate,omitempty"`
+	Data    *dataReport    `json:"data,omitempty"`
+	History []historyEntry `json:"history,omitempty"`
+	Runs    []runEntry     `json:"runs,omitempty"`
+	Status  *statusReport  `json:"status,omitempty"`
+}
+
+// migrateReport summarizes the migration files handled by a run
+type migrateReport struct {
+	Applied    []appliedFile `json:"applied"`
+	Skipped    []string      `json:"skipped"`
+	Excluded   []string      `json:"excluded"`
+	Failed     []failedFile  `json:"failed"`
+	Statements int           `json:"statements"`
+	Remaining  int           `json:"remaining"`
+}
+
+type appliedFile struct {
+	File       string `json:"file"`
+	Version    string `json:"version,omitempty"`
+	Statements int    `json:"statements"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type failedFile struct {
+	File       string `json:"file"`
+	Version    string `json:"version,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// dataReport summarizes the data files loaded with -data
+type dataReport struct {
+	Files   []dataFile `json:"files"`
+	Skipped []string   `json:"skipped"` // Unchanged since they were loaded
+	Rows    int        `json:"rows"`
+}
+
+type dataFile struct {
+	File   string `json:"file"`
+	Table  string `json:"table"`
+	Rows   int    `json:"rows"`
+	Reload string `json:"reload,omitempty"` // truncate or replace, for a changed file loaded again
+}
+
+// historyEntry is a schema_versions row as reported by -version
+type historyEntry struct {
+	Version     string    `json:"version"`
+	Description string    `json:"description"`
+	Filename    string    `json:"filename"`
+	AppliedAt   time.Time `json:"applied_at"`
+}
+
+// runEntry is a dbmigrate_runs row as reported by -history
+type runEntry struct {
+	RunID       string     `json:"run_id"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Outcome     string     `json:"outcome"`
+	Command     string     `json:"command"`
+	Applied     int        `json:"applied"`
+	Skipped     int        `json:"skipped"`
+	Failed      int        `json:"failed"`
+	Statements  int        `json:"statements"`
+	Error       string     `json:"error,omitempty"`
+	Flags       string     `json:"flags"`
+	ToolVersion string     `json:"tool_version"`
+}
+
+// statusReport is the -status table
+type statusReport struct {
+	UpToDate   bool           `json:"up_to_date"`
+	Counts     map[string]int `json:"counts"`
+	Migrations []statusEntry  `json:"migrations"`
+}
+
+type statusEntry struct {
+	Version    string     `json:"version"`
+	File       string     `json:"file"`
+	State      string     `json:"state"`
+	AppliedAt  *time.Time `json:"applied_at,omitempty"`
+	DurationMs int64      `json:"duration_ms,omitempty"`
+}
+
+// commandName returns the name of the command selected by the flags
+func commandName(cfg RunConfig) string {
+	switch {
+	case cfg.ShowVersion:
+		return "version"
+	case cfg.ShowStatus:
+		return "status"
+	case cfg.ShowHistory:
+		return "history"
+	default:
+		return "migrate"
+	}
+}
+
+// writeJSONReport writes the report as an indented JSON document
+func writeJSONReport(w io.Writer, report *runReport) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		fmt.Fprintf(w, "{\"command\": %q, \"success\": false, \"error\": %q}\n", report.Command, err.Error())
+		return
+	}
+	fmt.Fprintln(w, string(data))
+}
+
+// historyEntries converts schema_versions rows to history entries
+func historyEntries(rows []map[string]interface{}) []historyEntry {
+	entries := make([]historyEntry, 0, len(rows))
+	for _, row := range rows {
+		record := migrationRecordFromRow(row)
+		entries = append(entries, historyEntry{
+			Version:     record.Version,
+			Description: record.Description,
+			Filename:    record.Filename,
+			AppliedAt:   record.AppliedAt,
+		})
+	}
+	return entries
+}
+
+// newRunEntries converts dbmigrate_runs rows for JSON output
+func newRunEntries(records []runRecord) []runEntry {
+	entries := make([]runEntry, 0, len(records))
+	for _, r := range records {
+		entry := runEntry{
+			RunID:       r.RunID,
+			StartedAt:   r.StartedAt,
+			Outcome:     r.Outcome,
+			Command:     r.Command,
+			Applied:     r.Applied,
+			Skipped:     r.Skipped,
+			Failed:      r.Failed,
+			Statements:  r.Statements,
+			Error:       r.Error,
+			Flags:       r.Flags,
+			ToolVersion: r.ToolVersion,
+		}
+		if !r.FinishedAt.IsZero() {
+			finishedAt := r.FinishedAt
+			entry.FinishedAt = &finishedAt
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// newStatusReport converts the -status table for JSON output
+func newStatusReport(statuses []MigrationStatus) *statusReport {
+	report := &statusReport{
+		UpToDate:   !statusNeedsAction(statuses),
+		Counts:     countStatusStates(statuses),
+		Migrations: make([]statusEntry, 0, len(statuses)),
+	}
+	for _, status := range statuses {
+		entry := statusEntry{
+			Version:    status.Version,
+			File:       status.Filename,
+			State:      status.State,
+			DurationMs: status.Duration.Milliseconds(),
+		}
+		if !status.AppliedAt.IsZero() {
+			appliedAt := status.AppliedAt
+			entry.AppliedAt = &appliedAt
+		}
+		report.Migrations = append(report.Migrations, entry)
+	}
+	return report
+}
+
+// newDataReport converts the loaded data files for JSON output
+func newDataReport(loaded []LoadedFile) *dataReport {
+	report := &dataReport{Files: make([]dataFile, 0, len(loaded)), Skipped: []string{}}
+	for _, f := range loaded {
+		if f.Skipped {
+			report.Skipped = append(report.Skipped, f.File)
+			continue
+		}
+		report.Files = append(report.Files, dataFile{File: f.File, Table: f.Table, Rows: f.Rows, Reload: f.Reload})
+		report.Rows += f.Rows
+	}
+	return report
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runJSON runs dbmigrate with -output json and decodes the document written to stdout
+func runJSON(t *testing.T, executor DatabaseExecutor, args ...string) (int, runReport, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     append([]string{"-output", "json"}, args...),
+		Executor: executor,
+	}
+
+	exitCode := run(cfg)
+
+	var report runReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("stdout is not a JSON document: %v\n%s", err, stdout.String())
+	}
+	return exitCode, report, stderr.String()
+}
+
+// ============================================================================
+// Tests for -output json
+// ============================================================================
+
+func TestRunJSONMigrate(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0", "1.0.1")
+
+	exitCode, report, stderr := runJSON(t, &MockExecutor{}, "-path", indexPath)
+	if exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr)
+	}
+
+	if report.Command != "migrate" || !report.Success {
+		t.Errorf("expected successful migrate report, got %+v", report)
+	}
+	if report.Migrate == nil {
+		t.Fatal("expected migrate section")
+	}
+	if len(report.Migrate.Applied) != 2 {
+		t.Fatalf("expected 2 applied files, got %+v", report.Migrate.Applied)
+	}
+	if report.Migrate.Applied[0].File != "001.sql" || report.Migrate.Applied[0].Version != "1.0.0" {
+		t.Errorf("unexpected first applied file: %+v", report.Migrate.Applied[0])
+	}
+	if report.Migrate.Statements != 2 {
+		t.Errorf("expected 2 statements, got %d", report.Migrate.Statements)
+	}
+
+	// Progress output goes to stderr without colors
+	if !strings.Contains(stderr, "Migration complete") {
+		t.Errorf("expected progress on stderr, got %q", stderr)
+	}
+	if strings.Contains(stderr, "\033[") {
+		t.Errorf("expected no ANSI codes with -output json, got %q", stderr)
+	}
+}
+
+func TestRunJSONMigrateWithData(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+	dataDir := t.TempDir()
+	writeTestFile(t, dataDir, "users.csv", "id,name\n1,foo\n2,bar\n")
+
+	mock := &MockExecutor{tables: map[string][]tableColumn{"users": {{Name: "id", Type: "UInt64"}, {Name: "name", Type: "String"}}}}
+	exitCode, report, stderr := runJSON(t, mock, "-path", indexPath, "-data", dataDir)
+	if exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr)
+	}
+
+	if report.Data == nil || len(report.Data.Files) != 1 {
+		t.Fatalf("expected one loaded data file, got %+v", report.Data)
+	}
+	if report.Data.Files[0].Table != "users" || report.Data.Rows != 2 {
+		t.Errorf("unexpected data report: %+v", report.Data)
+	}
+}
+
+func TestRunJSONError(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+
+	exitCode, report, _ := runJSON(t, &MockExecutor{}, "-path", indexPath, "-target", "9.9.9")
+	if exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if report.Success {
+		t.Error("expected success to be false")
+	}
+	if !strings.Contains(report.Error, "target version 9.9.9 not found") {
+		t.Errorf("expected target error, got %q", report.Error)
+	}
+}
+
+func TestRunJSONExecutionError(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+
+	exitCode, report, _ := runJSON(t, &MockExecutor{shouldError: true}, "-path", indexPath)
+	if exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if report.Success || !strings.Contains(report.Error, "001.sql") {
+		t.Errorf("expected failing file in error, got %+v", report)
+	}
+}
+
+func TestRunJSONVersion(t *testing.T) {
+	appliedAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	mock := &MockExecutorWithRows{
+		rows: []map[string]interface{}{
+			{"version": "1.0.1", "applied_at": appliedAt, "description": "Second", "filename": "002.sql"},
+			{"version": "1.0.0", "applied_at": appliedAt, "description": "First", "filename": "001.sql"},
+		},
+	}
+
+	exitCode, report, _ := runJSON(t, mock, "-version")
+	if exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d", exitCode)
+	}
+
+	if report.Command != "version" {
+		t.Errorf("expected version command, got %q", report.Command)
+	}
+	if len(report.History) != 2 || report.History[0].Version != "1.0.1" {
+		t.Fatalf("unexpected history: %+v", report.History)
+	}
+	if !report.History[0].AppliedAt.Equal(appliedAt) {
+		t.Errorf("expected applied time, got %v", report.History[0].AppliedAt)
+	}
+}
+
+func TestRunJSONVersionQueryError(t *testing.T) {
+	exitCode, report, _ := runJSON(t, &MockExecutorWithRows{shouldError: true}, "-version")
+	if exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(report.Error, "could not query schema version") {
+		t.Errorf("expected query error, got %q", report.Error)
+	}
+}
+
+func TestRunJSONStatus(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+
+	exitCode, report, _ := runJSON(t, &MockExecutorWithRows{}, "-path", indexPath, "-status")
+	if exitCode != 1 {
+		t.Errorf("expected exit code 1 with pending migrations, got %d", exitCode)
+	}
+
+	if report.Status == nil {
+		t.Fatal("expected status section")
+	}
+	if report.Status.UpToDate {
+		t.Error("expected up_to_date to be false")
+	}
+	if report.Status.Counts[statePending] != 1 {
+		t.Errorf("expected 1 pending migration, got %v", report.Status.Counts)
+	}
+	if len(report.Status.Migrations) != 1 || report.Status.Migrations[0].State != statePending {
+		t.Errorf("unexpected migrations: %+v", report.Status.Migrations)
+	}
+}
+
+func TestRunInvalidOutput(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-output", "xml"},
+		Executor: &MockExecutor{},
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "-output must be") {
+		t.Errorf("expected output format error, got %q", stderr.String())
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	if name := commandName(RunConfig{ShowVersion: true}); name != "version" {
+		t.Errorf("expected 'version', got %q", name)
+	}
+	if name := commandName(RunConfig{ShowStatus: true}); name != "status" {
+		t.Errorf("expected 'status', got %q", name)
+	}
+	if name := commandName(RunConfig{}); name != "migrate" {
+		t.Errorf("expected 'migrate', got %q", name)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// migrationResult is the outcome of applying one migration
+type migrationResult struct {
+	statements int
+	duration   time.Duration
+	err        error
+}
+
+// scheduleMigrations calls apply for every migration in plan, running up to workers
+// at once. plan must be in dependency order (see orderMigrations). A migration starts
+// only after the planned migrations it requires have succeeded, and the earliest ready
+// migration is always started first, so with one worker plan order is followed exactly.
+// Index order is kept for migrations without -- parallel: true: they start after every
+// earlier migration, and later ones start after them, so only neighbouring parallel
+// migrations run at once. With serialFirst the first migration runs before any other
+// starts. After a failure no new migrations are started. Results are returned in plan
+// order; migrations that were never started have a nil result.
+func scheduleMigrations(plan []MigrationInfo, workers int, serialFirst bool, apply func(MigrationInfo) migrationResult) []*migrationResult {
+	if workers < 1 {
+		workers = 1
+	}
+
+	positions := make(map[string][]int)
+	for i, info := range plan {
+		if info.Version != "" {
+			positions[info.Version] = append(positions[info.Version], i)
+		}
+	}
+	dependents := make([][]int, len(plan))
+	waiting := make([]int, len(plan))
+	after := func(dep, i int) {
+		dependents[dep] = append(dependents[dep], i)
+		waiting[i]++
+	}
+	barrier := -1      // Last migration without -- parallel: true
+	var parallel []int // Parallel migrations since barrier
+	for i, info := range plan {
+		for _, required := range info.Requires {
+			for _, dep := range positions[required] {
+				if dep < i {
+					after(dep, i)
+				}
+			}
+		}
+		if serialFirst && i > 0 {
+			after(0, i)
+		}
+		if barrier >= 0 {
+			after(barrier, i)
+		}
+		if info.Parallel {
+			parallel = append(parallel, i)
+			continue
+		}
+		for _, dep := range parallel {
+			after(dep, i)
+		}
+		barrier, parallel = i, nil
+	}
+
+	var ready []int
+	for i := range plan {
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	type completion struct {
+		index  int
+		result migrationResult
+	}
+	completed := make(chan completion)
+	results := make([]*migrationResult, len(plan))
+	running := 0
+	failed := false
+
+	for {
+		for !failed && running < workers && len(ready) > 0 {
+			next := ready[0]
+			ready = ready[1:]
+			running++
+			go func(i int) {
+				completed <- completion{index: i, result: apply(plan[i])}
+			}(next)
+		}
+		if running == 0 {
+			break
+		}
+
+		c := <-completed
+		running--
+		results[c.index] = &c.result
+		if c.result.err != nil {
+			failed = true
+			continue
+		}
+		for _, dependent := range dependents[c.index] {
+			waiting[dependent]--
+			if waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+		sort.Ints(ready)
+	}
+
+	return results
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// applyRecorder is an apply function for scheduleMigrations that records the order
+// migrations finish in and the highest number running at once
+type applyRecorder struct {
+	mu       sync.Mutex
+	running  int
+	peak     int
+	finished []string
+	fail     string
+}
+
+func (r *applyRecorder) apply(info MigrationInfo) migrationResult {
+	r.mu.Lock()
+	r.running++
+	r.peak = max(r.peak, r.running)
+	r.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running--
+	r.finished = append(r.finished, info.Version)
+	if info.Version == r.fail {
+		return migrationResult{err: errors.New("boom")}
+	}
+	return migrationResult{statements: 1}
+}
+
+// independentPlan returns n migrations without dependencies that may run in parallel
+func independentPlan(n int) []MigrationInfo {
+	plan := make([]MigrationInfo, n)
+	for i := range plan {
+		plan[i] = MigrationInfo{Version: fmt.Sprintf("1.0.%d", i), Parallel: true}
+	}
+	return plan
+}
+
+// ============================================================================
+// Tests for scheduleMigrations
+// ============================================================================
+
+func TestScheduleMigrationsSequential(t *testing.T) {
+	r := &applyRecorder{}
+	plan := independentPlan(4)
+
+	results := scheduleMigrations(plan, 1, false, r.apply)
+
+	if r.peak != 1 {
+		t.Errorf("expected one migration at a time, got %d", r.peak)
+	}
+	if !reflect.DeepEqual(r.finished, migrationVersions(plan)) {
+		t.Errorf("expected plan order, got %v", r.finished)
+	}
+	for i, result := range results {
+		if result == nil || result.err != nil {
+			t.Errorf("result %d: expected success, got %+v", i, result)
+		}
+	}
+}
+
+func TestScheduleMigrationsParallel(t *testing.T) {
+	r := &applyRecorder{}
+
+	scheduleMigrations(independentPlan(8), 4, false, r.apply)
+
+	if r.peak < 2 || r.peak > 4 {
+		t.Errorf("expected between 2 and 4 migrations at once, got %d", r.peak)
+	}
+	if len(r.finished) != 8 {
+		t.Errorf("expected all migrations to run, got %v", r.finished)
+	}
+}
+
+func TestScheduleMigrationsRespectsRequires(t *testing.T) {
+	r := &applyRecorder{}
+	plan := []MigrationInfo{
+		{Version: "a", Parallel: true},
+		{Version: "b", Parallel: true},
+		{Version: "c", Requires: []string{"a"}, Parallel: true},
+		{Version: "d", Requires: []string{"c", "b"}, Parallel: true},
+	}
+
+	scheduleMigrations(plan, 4, false, r.apply)
+
+	position := make(map[string]int)
+	for i, version := range r.finished {
+		position[version] = i
+	}
+	if position["c"] < position["a"] || position["d"] < position["c"] || position["d"] < position["b"] {
+		t.Errorf("dependencies finished out of order: %v", r.finished)
+	}
+}
+
+func TestScheduleMigrationsKeepsIndexOrder(t *testing.T) {
+	r := &applyRecorder{}
+	plan := []MigrationInfo{
+		{Version: "create"},
+		{Version: "alter"},
+		{Version: "view1", Parallel: true},
+		{Version: "view2", Parallel: true},
+		{Version: "view3", Parallel: true},
+		{Version: "grant"},
+	}
+
+	scheduleMigrations(plan, 4, false, r.apply)
+
+	if !reflect.DeepEqual(r.finished[:2], []string{"create", "alter"}) || r.finished[5] != "grant" {
+		t.Errorf("expected migrations without -- parallel: true in index order, got %v", r.finished)
+	}
+	if r.peak != 3 {
+		t.Errorf("expected the three parallel migrations to run at once, got %d", r.peak)
+	}
+}
+
+func TestScheduleMigrationsSerialFirst(t *testing.T) {
+	r := &applyRecorder{}
+
+	scheduleMigrations(independentPlan(5), 5, true, r.apply)
+
+	if r.finished[0] != "1.0.0" {
+		t.Errorf("expected the first migration to finish before the others start, got %v", r.finished)
+	}
+}
+
+func TestScheduleMigrationsStopsAfterFailure(t *testing.T) {
+	r := &applyRecorder{fail: "1.0.1"}
+
+	results := scheduleMigrations(independentPlan(5), 1, false, r.apply)
+
+	if results[1] == nil || results[1].err == nil {
+		t.Fatalf("expected failure result for 1.0.1, got %+v", results[1])
+	}
+	for _, result := range results[2:] {
+		if result != nil {
+			t.Errorf("expected no migrations to start after the failure, got %+v", result)
+		}
+	}
+}
+
+func TestParseMigrationInfoParallelHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	path := writeTestFile(t, dir, "001_view.sql", "-- version: 1.0.0\n-- parallel: true\nCREATE VIEW v AS SELECT 1;\n")
+	info, err := parseMigrationInfo(path)
+	if err != nil {
+		t.Fatalf("parseMigrationInfo failed: %v", err)
+	}
+	if !info.Parallel {
+		t.Errorf("expected Parallel, got %+v", info)
+	}
+
+	path = writeTestFile(t, dir, "002_bad.sql", "-- version: 1.0.1\n-- parallel: maybe\nSELECT 1;\n")
+	if _, err := parseMigrationInfo(path); err == nil {
+		t.Error("expected an invalid parallel header to fail")
+	}
+}
+
+// ============================================================================
+// Tests for -parallel in run
+// ============================================================================
+
+func TestRunParallel(t *testing.T) {
+	versions := make([]string, 20)
+	for i := range versions {
+		versions[i] = fmt.Sprintf("1.0.%d", i)
+	}
+	indexPath := writeMigrationTree(t, versions...)
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-parallel", "4", "-output", "json"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	if len(migrationStatements(mock.executedSQL)) != 20 {
+		t.Errorf("expected 20 statements, got %d", len(migrationStatements(mock.executedSQL)))
+	}
+	if mock.connectOptions.MaxConns != 5 {
+		t.Errorf("expected a connection per worker plus one, got %d", mock.connectOptions.MaxConns)
+	}
+
+	// The summary lists files in index order regardless of completion order
+	output := stdout.String()
+	last := -1
+	for _, version := range versions {
+		pos := strings.Index(output, `"version": "`+version+`"`)
+		if pos < last {
+			t.Fatalf("expected applied files in index order, got %s", output)
+		}
+		last = pos
+	}
+}
+
+// concurrencyExecutor records the highest number of migration statements running at once
+type concurrencyExecutor struct {
+	MockExecutor
+	mu      sync.Mutex
+	running int
+	peak    int
+}
+
+func (m *concurrencyExecutor) Execute(ctx context.Context, sql string) error {
+	if strings.Contains(sql, "CREATE TABLE t") {
+		m.mu.Lock()
+		m.running++
+		m.peak = max(m.peak, m.running)
+		m.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		m.mu.Lock()
+		m.running--
+		m.mu.Unlock()
+	}
+	return m.MockExecutor.Execute(ctx, sql)
+}
+
+func TestRunParallelUnordered(t *testing.T) {
+	versions := make([]string, 8)
+	for i := range versions {
+		versions[i] = fmt.Sprintf("1.0.%d", i)
+	}
+	indexPath := writeMigrationTree(t, versions...)
+
+	for _, tt := range []struct {
+		args []string
+		peak int
+	}{
+		{[]string{"-parallel", "4"}, 1},
+		{[]string{"-parallel", "4", "-unordered"}, 4},
+	} {
+		mock := &concurrencyExecutor{}
+		var stdout, stderr bytes.Buffer
+		cfg := RunConfig{
+			Stdout:   &stdout,
+			Stderr:   &stderr,
+			Args:     append([]string{"-path", indexPath}, tt.args...),
+			Executor: mock,
+		}
+		if exitCode := run(cfg); exitCode != 0 {
+			t.Fatalf("%v: expected exit code 0, got %d: %s", tt.args, exitCode, stderr.String())
+		}
+		if mock.peak != tt.peak {
+			t.Errorf("%v: expected up to %d migrations at once, got %d", tt.args, tt.peak, mock.peak)
+		}
+	}
+}
+
+func TestRunInvalidParallel(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-parallel", "-2"},
+		Executor: &MockExecutor{},
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "-parallel must be at least 1") {
+		t.Errorf("expected parallel error, got %q", stderr.String())
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// resolvePassword fills in cfg.Password when it was not given with -password or
+// DBMIGRATE_PASSWORD: from -password-file, or with -W by prompting on a terminal
+// or reading the first line of piped stdin
+func resolvePassword(cfg *RunConfig, logger *Logger) error {
+	if cfg.Password != "" || cfg.SkipPassword {
+		return nil
+	}
+
+	if cfg.PasswordFile != "" {
+		password, err := readPasswordFile(cfg.PasswordFile)
+		if err != nil {
+			return err
+		}
+		cfg.Password = password
+		return nil
+	}
+
+	if !cfg.PromptPassword {
+		return nil
+	}
+
+	if f, ok := cfg.Stdin.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		fmt.Fprintf(logger.err, "Password for user %s: ", cfg.User)
+		bytepw, err := term.ReadPassword(int(f.Fd()))
+		fmt.Fprintln(logger.err) // New line after password input
+		if err != nil {
+			return fmt.Errorf("reading password: %w", err)
+		}
+		cfg.Password = string(bytepw)
+		return nil
+	}
+
+	if cfg.Stdin == nil {
+		return fmt.Errorf("reading password: no terminal or piped input available")
+	}
+	password, err := readPasswordLine(cfg.Stdin)
+	if err != nil {
+		return fmt.Errorf("reading password from stdin: %w", err)
+	}
+	cfg.Password = password
+	return nil
+}
+
+// readPasswordFile returns the contents of a password file without the trailing newline
+func readPasswordFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading password file: %w", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("password file %s is empty", path)
+	}
+	return password, nil
+}
+
+// readPasswordLine reads the first line of r, e.g. from `echo $PW | dbmigrate -W ...`
+func readPasswordLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", fmt.Errorf("no password received")
+	}
+	return password, nil
+}
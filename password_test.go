@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// Tests for resolvePassword
+// ============================================================================
+
+func TestResolvePasswordKeepsExplicitPassword(t *testing.T) {
+	cfg := RunConfig{Password: "given", PromptPassword: true, Stdin: strings.NewReader("piped\n")}
+
+	if err := resolvePassword(&cfg, testLogger(io.Discard)); err != nil {
+		t.Fatalf("resolvePassword failed: %v", err)
+	}
+	if cfg.Password != "given" {
+		t.Errorf("expected explicit password to be kept, got %q", cfg.Password)
+	}
+}
+
+func TestResolvePasswordFromFile(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "password", "s3cret\n")
+	cfg := RunConfig{PasswordFile: path}
+
+	if err := resolvePassword(&cfg, testLogger(io.Discard)); err != nil {
+		t.Fatalf("resolvePassword failed: %v", err)
+	}
+	if cfg.Password != "s3cret" {
+		t.Errorf("expected password without newline, got %q", cfg.Password)
+	}
+}
+
+func TestResolvePasswordFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	empty := writeTestFile(t, dir, "empty", "\n")
+
+	for _, path := range []string{empty, filepath.Join(dir, "missing")} {
+		cfg := RunConfig{PasswordFile: path}
+		if err := resolvePassword(&cfg, testLogger(io.Discard)); err == nil {
+			t.Errorf("expected error for password file %s", path)
+		}
+	}
+}
+
+func TestResolvePasswordFromPipedStdin(t *testing.T) {
+	cfg := RunConfig{PromptPassword: true, Stdin: strings.NewReader("s3cret\r\nignored\n")}
+
+	if err := resolvePassword(&cfg, testLogger(io.Discard)); err != nil {
+		t.Fatalf("resolvePassword failed: %v", err)
+	}
+	if cfg.Password != "s3cret" {
+		t.Errorf("expected first line of stdin, got %q", cfg.Password)
+	}
+}
+
+func TestResolvePasswordEmptyStdin(t *testing.T) {
+	cfg := RunConfig{PromptPassword: true, Stdin: strings.NewReader("")}
+
+	err := resolvePassword(&cfg, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "no password received") {
+		t.Errorf("expected no password error, got %v", err)
+	}
+}
+
+func TestResolvePasswordWithoutPrompt(t *testing.T) {
+	cfg := RunConfig{Stdin: strings.NewReader("s3cret\n")}
+
+	if err := resolvePassword(&cfg, testLogger(io.Discard)); err != nil {
+		t.Fatalf("resolvePassword failed: %v", err)
+	}
+	if cfg.Password != "" {
+		t.Errorf("stdin should only be read with -W, got %q", cfg.Password)
+	}
+}
+
+func TestRunPasswordFromEnvironment(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+	t.Setenv("DBMIGRATE_PASSWORD", "from-env")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-W"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	if mock.connectOptions.Password != "from-env" {
+		t.Errorf("expected password from DBMIGRATE_PASSWORD, got %q", mock.connectOptions.Password)
+	}
+}
+
+func TestRunPasswordFileOverridesEnvironment(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+	passwordFile := writeTestFile(t, t.TempDir(), "password", "from-file\n")
+	t.Setenv("DBMIGRATE_PASSWORD", "from-env")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-password-file", passwordFile},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	if mock.connectOptions.Password != "from-file" {
+		t.Errorf("expected password from -password-file, got %q", mock.connectOptions.Password)
+	}
+}
+
+func TestRunRedactsPassword(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", filepath.Join(t.TempDir(), "s3cret", "index.lst"), "-password", "s3cret", "-output", "json"},
+		Executor: &MockExecutor{},
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+	if strings.Contains(stdout.String()+stderr.String(), "s3cret") {
+		t.Errorf("expected password to be redacted, got stdout %q stderr %q", stdout.String(), stderr.String())
+	}
+	if !strings.Contains(stderr.String(), redactedText) {
+		t.Errorf("expected redaction marker in error, got %q", stderr.String())
+	}
+}
+
+func TestRunRedactsEscapedDSNPassword(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0")
+	dsn := "clickhouse://u:p%40ss@h:9000/db"
+
+	for _, args := range [][]string{{"-dsn", dsn}, {"-dsn=" + dsn}, {"--dsn", dsn}} {
+		mock := &MockExecutor{}
+		var stdout, stderr bytes.Buffer
+		cfg := RunConfig{
+			Stdout:   &stdout,
+			Stderr:   &stderr,
+			Args:     append(args, "-path", indexPath),
+			Executor: mock,
+		}
+		if exitCode := run(cfg); exitCode != 0 {
+			t.Fatalf("%v: expected exit code 0, got %d: %s", args, exitCode, stderr.String())
+		}
+		if mock.connectOptions.Password != "p@ss" {
+			t.Errorf("%v: expected the decoded password, got %q", args, mock.connectOptions.Password)
+		}
+		history := strings.Join(mock.historySQL, "\n")
+		if strings.Contains(history, "p%40ss") || strings.Contains(history, "p@ss") {
+			t.Errorf("%v: expected the password redacted in dbmigrate_runs, got %s", args, history)
+		}
+		if !strings.Contains(history, "clickhouse://u:********@h:9000/db") {
+			t.Errorf("%v: expected the redacted DSN in dbmigrate_runs, got %s", args, history)
+		}
+	}
+}
+
+func TestRedactDSN(t *testing.T) {
+	tests := []struct{ dsn, want string }{
+		{"clickhouse://u:p%40ss@h:9000/db", "clickhouse://u:********@h:9000/db"},
+		{"clickhouse://u:p@ss@h/db?secure=true", "clickhouse://u:********@h/db?secure=true"},
+		{"clickhouse://u@h:9000/db", "clickhouse://u@h:9000/db"},
+		{"clickhouse://h:9000/db?user=a@b", "clickhouse://h:9000/db?user=a@b"},
+		{"not a url", "not a url"},
+	}
+	for _, tt := range tests {
+		if got := redactDSN(tt.dsn); got != tt.want {
+			t.Errorf("redactDSN(%q) = %q, want %q", tt.dsn, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// retryableCodes are ClickHouse exception codes for conditions that usually clear up
+// on their own, such as replica restarts, merges catching up or lost connections
+var retryableCodes = map[int32]string{
+	202: "TOO_MANY_SIMULTANEOUS_QUERIES",
+	209: "SOCKET_TIMEOUT",
+	210: "NETWORK_ERROR",
+	225: "NO_ZOOKEEPER",
+	242: "TABLE_IS_READ_ONLY",
+	252: "TOO_MANY_PARTS",
+	279: "ALL_CONNECTION_TRIES_FAILED",
+	319: "UNKNOWN_STATUS_OF_INSERT",
+	999: "KEEPER_EXCEPTION",
+}
+
+// retryPolicy controls how often and how fast statements failing with a transient
+// error are retried. The delay doubles after every retry, up to MaxBackoff.
+type retryPolicy struct {
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// delay returns how long to wait before the given retry (0 = first retry)
+func (p retryPolicy) delay(retry int) time.Duration {
+	d := p.Backoff
+	for i := 0; i < retry && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// isRetryable reports whether err is a transient ClickHouse or network error. A
+// statement that ran into its own timeout is not retried.
+func isRetryable(err error) bool {
+	var timeout *statementTimeoutError
+	if errors.As(err, &timeout) {
+		return false
+	}
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		_, ok := retryableCodes[exception.Code]
+		return ok
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// isIdempotent reports whether running sql twice has the same effect as running it
+// once, so it can be retried after an error that may have hit it half way: reads,
+// CREATE IF NOT EXISTS / OR REPLACE, DROP IF EXISTS, and ALTERs that only use
+// IF [NOT] EXISTS actions. INSERTs, mutations, TRUNCATE, OPTIMIZE and SYSTEM
+// commands are never considered idempotent.
+func isIdempotent(sql string) bool {
+	s := strings.ToUpper(strings.Join(strings.Fields(stripLeadingComments(sql)), " "))
+	keyword, _, _ := strings.Cut(s, " ")
+
+	switch keyword {
+	case "SELECT", "WITH", "SHOW", "DESCRIBE", "DESC", "EXISTS", "EXPLAIN", "CHECK":
+		return true
+	case "CREATE":
+		return strings.Contains(s, " IF NOT EXISTS ") || strings.HasPrefix(s, "CREATE OR REPLACE ")
+	case "DROP", "DETACH":
+		return strings.Contains(s, " IF EXISTS ")
+	case "ALTER":
+		if strings.Contains(s, " UPDATE ") || strings.Contains(s, " DELETE ") {
+			return false
+		}
+		// Every comma-separated action must be guarded
+		for _, action := range strings.Split(s, ",") {
+			if !strings.Contains(action, " IF EXISTS ") && !strings.Contains(action, " IF NOT EXISTS ") {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// stripLeadingComments removes comments and whitespace before the first keyword
+func stripLeadingComments(sql string) string {
+	for {
+		sql = strings.TrimSpace(sql)
+		switch {
+		case strings.HasPrefix(sql, "--"):
+			_, rest, found := strings.Cut(sql, "\n")
+			if !found {
+				return ""
+			}
+			sql = rest
+		case strings.HasPrefix(sql, "/*"):
+			_, rest, found := strings.Cut(sql, "*/")
+			if !found {
+				return ""
+			}
+			sql = rest
+		default:
+			return sql
+		}
+	}
+}
+
+// waitRetry sleeps before a retry, returning errInterrupted if ctx is cancelled first
+func waitRetry(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return errInterrupted
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryDescription names the exception code of err for retry log lines
+func retryDescription(err error) string {
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		if name, ok := retryableCodes[exception.Code]; ok {
+			return fmt.Sprintf("%s (code %d)", name, exception.Code)
+		}
+	}
+	return err.Error()
+}
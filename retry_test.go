@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// flakyExecutor fails the first failures statements with err, then succeeds
+type flakyExecutor struct {
+	MockExecutor
+	failures int
+	err      error
+	attempts int
+}
+
+func (m *flakyExecutor) Execute(ctx context.Context, sql string) error {
+	m.attempts++
+	if m.attempts <= m.failures {
+		return m.err
+	}
+	return m.MockExecutor.Execute(ctx, sql)
+}
+
+// fastRetries retries quickly enough for tests
+var fastRetries = retryPolicy{Retries: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+
+// ============================================================================
+// Tests for retry classification
+// ============================================================================
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"too many parts", &clickhouse.Exception{Code: 252}, true},
+		{"wrapped keeper exception", fmt.Errorf("failed: %w", &clickhouse.Exception{Code: 999}), true},
+		{"syntax error", &clickhouse.Exception{Code: 62}, false},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true},
+		{"deadline", context.DeadlineExceeded, false},
+		{"cancelled", context.Canceled, false},
+		{"plain error", fmt.Errorf("table already exists"), false},
+		{"network timeout", &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, true},
+		{"statement timeout", &statementTimeoutError{timeout: time.Second, err: &net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsIdempotent(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"SELECT 1", true},
+		{"-- comment\n/* block */ select count() from t", true},
+		{"CREATE TABLE IF NOT EXISTS t (id UInt64) ENGINE = Memory", true},
+		{"CREATE TABLE t (id UInt64) ENGINE = Memory", false},
+		{"CREATE OR REPLACE VIEW v AS SELECT 1", true},
+		{"DROP TABLE IF EXISTS t", true},
+		{"DROP TABLE t", false},
+		{"ALTER TABLE t ADD COLUMN IF NOT EXISTS a UInt8, DROP COLUMN IF EXISTS b", true},
+		{"ALTER TABLE t ADD COLUMN IF NOT EXISTS a UInt8, DROP COLUMN b", false},
+		{"ALTER TABLE t UPDATE a = 1 WHERE 1", false},
+		{"INSERT INTO t VALUES (1)", false},
+		{"TRUNCATE TABLE t", false},
+		{"OPTIMIZE TABLE t FINAL DEDUPLICATE", false},
+		{"SYSTEM DROP REPLICA 'r1' FROM TABLE t", false},
+		{"SYSTEM RESTART REPLICA t", false},
+	}
+	for _, tt := range tests {
+		if got := isIdempotent(tt.sql); got != tt.want {
+			t.Errorf("isIdempotent(%q) = %v, want %v", tt.sql, got, tt.want)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	policy := retryPolicy{Retries: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for retry, expected := range want {
+		if got := policy.delay(retry); got != expected {
+			t.Errorf("delay(%d) = %s, want %s", retry, got, expected)
+		}
+	}
+}
+
+// ============================================================================
+// Tests for retrying statements
+// ============================================================================
+
+func TestExecuteStatementRetriesTransientErrors(t *testing.T) {
+	mock := &flakyExecutor{failures: 2, err: &clickhouse.Exception{Code: 252, Message: "Too many parts"}}
+	var out bytes.Buffer
+
+	err := executeStatement(ctxbg, mock, "CREATE TABLE IF NOT EXISTS t (id UInt64) ENGINE = Memory", statementOptions{retry: fastRetries}, testLogger(&out))
+	if err != nil {
+		t.Fatalf("expected the statement to succeed after retries, got %v", err)
+	}
+	if mock.attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", mock.attempts)
+	}
+	if got := strings.Count(out.String(), "TOO_MANY_PARTS (code 252), retrying"); got != 2 {
+		t.Errorf("expected 2 retry log lines, got %d:\n%s", got, out.String())
+	}
+}
+
+func TestExecuteStatementGivesUpAfterRetries(t *testing.T) {
+	mock := &flakyExecutor{failures: 10, err: &clickhouse.Exception{Code: 252}}
+
+	err := executeStatement(ctxbg, mock, "SELECT 1", statementOptions{retry: fastRetries}, testLogger(&bytes.Buffer{}))
+	if err == nil {
+		t.Fatal("expected an error once retries run out")
+	}
+	if mock.attempts != 4 {
+		t.Errorf("expected 1 attempt and 3 retries, got %d attempts", mock.attempts)
+	}
+}
+
+func TestExecuteStatementDoesNotRetryNonIdempotent(t *testing.T) {
+	transient := &clickhouse.Exception{Code: 319}
+
+	mock := &flakyExecutor{failures: 1, err: transient}
+	err := executeStatement(ctxbg, mock, "INSERT INTO t VALUES (1)", statementOptions{retry: fastRetries}, testLogger(&bytes.Buffer{}))
+	if err == nil || mock.attempts != 1 {
+		t.Errorf("expected the INSERT to fail without a retry, got %v after %d attempt(s)", err, mock.attempts)
+	}
+
+	mock = &flakyExecutor{failures: 1, err: transient}
+	err = executeStatement(ctxbg, mock, "INSERT INTO t VALUES (1)", statementOptions{retry: fastRetries, retrySafe: true}, testLogger(&bytes.Buffer{}))
+	if err != nil || mock.attempts != 2 {
+		t.Errorf("expected -- retry: safe to allow a retry, got %v after %d attempt(s)", err, mock.attempts)
+	}
+}
+
+func TestExecuteStatementDoesNotRetryPermanentErrors(t *testing.T) {
+	mock := &flakyExecutor{failures: 1, err: &clickhouse.Exception{Code: 62, Message: "Syntax error"}}
+
+	err := executeStatement(ctxbg, mock, "SELECT 1", statementOptions{retry: fastRetries}, testLogger(&bytes.Buffer{}))
+	if err == nil || mock.attempts != 1 {
+		t.Errorf("expected a syntax error to fail without a retry, got %v after %d attempt(s)", err, mock.attempts)
+	}
+}
+
+// deadlineExecutor blocks statements until their context ends, then fails them with
+// a network timeout like the driver does when the connection deadline passes
+type deadlineExecutor struct {
+	MockExecutor
+	attempts int
+}
+
+func (m *deadlineExecutor) Execute(ctx context.Context, sql string) error {
+	m.attempts++
+	<-ctx.Done()
+	return &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}
+}
+
+func TestExecuteStatementDoesNotRetryOwnTimeout(t *testing.T) {
+	mock := &deadlineExecutor{}
+	opts := statementOptions{timeout: 10 * time.Millisecond, retry: fastRetries}
+
+	err := executeStatement(ctxbg, mock, "SELECT sleep(3)", opts, testLogger(io.Discard))
+	if err == nil || !strings.Contains(err.Error(), "exceeded the 10ms timeout") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if mock.attempts != 1 {
+		t.Errorf("expected a statement hitting its timeout not to be retried, got %d attempt(s)", mock.attempts)
+	}
+}
+
+func TestParseMigrationInfoRetryHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "001_backfill.sql")
+	if err := os.WriteFile(path, []byte("-- version: 1.0.0\n-- retry: safe\nINSERT INTO t SELECT * FROM s;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := parseMigrationInfo(path)
+	if err != nil {
+		t.Fatalf("parseMigrationInfo failed: %v", err)
+	}
+	if !info.RetrySafe || info.RetryNever {
+		t.Errorf("expected RetrySafe, got %+v", info)
+	}
+
+	path = filepath.Join(dir, "002_bad.sql")
+	if err := os.WriteFile(path, []byte("-- version: 1.0.1\n-- retry: sometimes\nSELECT 1;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseMigrationInfo(path); err == nil {
+		t.Error("expected an invalid retry header to fail")
+	}
+}
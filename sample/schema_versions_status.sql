@@ -0,0 +1,6 @@
+-- version: 1.0.2
+-- description: Track status and duration of each migration in schema_versions
+
+ALTER TABLE schema_versions
+    ADD COLUMN IF NOT EXISTS status String DEFAULT 'applied',
+    ADD COLUMN IF NOT EXISTS duration_ms UInt64 DEFAULT 0;
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// serverBlockRegex matches the markers of alternative statement blocks:
+// -- @server <constraint> starts a block, -- @end closes the last one
+var serverBlockRegex = regexp.MustCompile(`^--\s*@(server|end)\b\s*(.*)$`)
+
+// versionConstraint is one comparison such as >=24.3
+type versionConstraint struct {
+	op      string
+	version []int
+}
+
+// parseVersion returns the numeric components of a version such as 24.3.1.2672,
+// ignoring anything after the first character that is not a digit or dot
+func parseVersion(s string) ([]int, error) {
+	s = strings.TrimSpace(s)
+	end := strings.IndexFunc(s, func(r rune) bool { return r != '.' && (r < '0' || r > '9') })
+	if end >= 0 {
+		s = s[:end]
+	}
+	if s == "" {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+
+	var parts []int
+	for _, part := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
+// formatVersion joins version components with dots
+func formatVersion(version []int) string {
+	parts := make([]string, len(version))
+	for i, n := range version {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ".")
+}
+
+// parseServerConstraints parses a comma-separated list of constraints that must all
+// hold, e.g. ">=23.8, <24.3". Supported operators are >=, >, <=, <, = and !=.
+func parseServerConstraints(s string) ([]versionConstraint, error) {
+	var constraints []versionConstraint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		op := ""
+		for _, candidate := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(part, candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("invalid server version constraint %q: expected an operator such as >=", part)
+		}
+		version, err := parseVersion(strings.TrimPrefix(part, op))
+		if err != nil {
+			return nil, fmt.Errorf("invalid server version constraint %q: %w", part, err)
+		}
+		constraints = append(constraints, versionConstraint{op: op, version: version})
+	}
+	if len(constraints) == 0 {
+		return nil, fmt.Errorf("empty server version constraint")
+	}
+	return constraints, nil
+}
+
+// compareVersions compares server against want on the components want has, so
+// 24.3.1 compares equal to 24.3. It returns -1, 0 or 1.
+func compareVersions(server, want []int) int {
+	for i, w := range want {
+		s := 0
+		if i < len(server) {
+			s = server[i]
+		}
+		if s < w {
+			return -1
+		}
+		if s > w {
+			return 1
+		}
+	}
+	return 0
+}
+
+// matches reports whether the server version satisfies the constraint
+func (c versionConstraint) matches(server []int) bool {
+	cmp := compareVersions(server, c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case ">":
+		return cmp > 0
+	case "<=":
+		return cmp <= 0
+	case "<":
+		return cmp < 0
+	case "=":
+		return cmp == 0
+	default: // !=
+		return cmp != 0
+	}
+}
+
+// serverMatches reports whether the server version satisfies a constraint list
+func serverMatches(constraints string, server []int) (bool, error) {
+	parsed, err := parseServerConstraints(constraints)
+	if err != nil {
+		return false, err
+	}
+	for _, c := range parsed {
+		if !c.matches(server) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// getServerVersion returns the version reported by SELECT version()
+func getServerVersion(executor DatabaseExecutor) (string, error) {
+	rows, err := executor.Query(ctxbg, "SELECT version() AS version")
+	if err != nil {
+		return "", err
+	}
+	if len(rows) == 0 {
+		return "", fmt.Errorf("SELECT version() returned no rows")
+	}
+	version, ok := rows[0]["version"].(string)
+	if !ok || version == "" {
+		return "", fmt.Errorf("SELECT version() returned no version")
+	}
+	return version, nil
+}
+
+// selectServerBlocks keeps the lines of sql outside -- @server blocks and the lines of
+// blocks whose constraint matches the server version, dropping the marker lines.
+// Blocks cannot be nested; a new -- @server marker ends the previous block.
+func selectServerBlocks(sql string, server []int) (string, error) {
+	if !strings.Contains(sql, "--") || !strings.Contains(sql, "@") {
+		return sql, nil
+	}
+
+	var out strings.Builder
+	inBlock, keep := false, true
+	lineNum := 0
+	scanner := bufio.NewScanner(strings.NewReader(sql))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(sql)+1)
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		matches := serverBlockRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			if keep {
+				out.WriteString(line)
+				out.WriteByte('\n')
+			}
+			continue
+		}
+
+		if matches[1] == "end" {
+			if !inBlock {
+				return "", fmt.Errorf("line %d: -- @end without -- @server", lineNum)
+			}
+			inBlock, keep = false, true
+			continue
+		}
+		if server == nil {
+			return "", fmt.Errorf("line %d: -- @server blocks need the server version", lineNum)
+		}
+		matched, err := serverMatches(matches[2], server)
+		if err != nil {
+			return "", fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		inBlock, keep = true, matched
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	if inBlock {
+		return "", fmt.Errorf("-- @server block without -- @end")
+	}
+	return out.String(), nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// serverMock answers SELECT version() and nothing else
+type serverMock struct {
+	MockExecutor
+	version string
+}
+
+func (m *serverMock) Query(ctx context.Context, sql string) ([]map[string]interface{}, error) {
+	if strings.Contains(sql, "version()") {
+		return []map[string]interface{}{{"version": m.version}}, nil
+	}
+	return nil, nil
+}
+
+// ============================================================================
+// Tests for version constraints
+// ============================================================================
+
+func TestParseVersion(t *testing.T) {
+	version, err := parseVersion("24.3.1.2672-stable")
+	if err != nil {
+		t.Fatalf("parseVersion failed: %v", err)
+	}
+	if !reflect.DeepEqual(version, []int{24, 3, 1, 2672}) {
+		t.Errorf("unexpected version %v", version)
+	}
+	if _, err := parseVersion("latest"); err == nil {
+		t.Error("expected error for non-numeric version")
+	}
+}
+
+func TestServerMatches(t *testing.T) {
+	server := []int{24, 3, 1, 2672}
+
+	tests := []struct {
+		constraints string
+		expected    bool
+	}{
+		{">=24.3", true},
+		{">=24.4", false},
+		{">24.3", false},
+		{">24.2", true},
+		{"<24.3", false},
+		{"<=24.3", true},
+		{"=24.3", true},
+		{"!=24.3", false},
+		{">=23.8, <24.3", false},
+		{">=23.8, <24.4", true},
+	}
+
+	for _, tt := range tests {
+		matched, err := serverMatches(tt.constraints, server)
+		if err != nil {
+			t.Fatalf("serverMatches(%q) failed: %v", tt.constraints, err)
+		}
+		if matched != tt.expected {
+			t.Errorf("serverMatches(%q) = %v, expected %v", tt.constraints, matched, tt.expected)
+		}
+	}
+}
+
+func TestServerMatchesInvalid(t *testing.T) {
+	for _, constraints := range []string{"24.3", ">=", ">=x", ""} {
+		if _, err := serverMatches(constraints, []int{24}); err == nil {
+			t.Errorf("serverMatches(%q): expected error", constraints)
+		}
+	}
+}
+
+// ============================================================================
+// Tests for selectServerBlocks
+// ============================================================================
+
+const serverBlockSQL = `CREATE TABLE t (x UInt8) ENGINE = MergeTree ORDER BY x;
+-- @server >=23.3
+DELETE FROM t WHERE x = 1;
+-- @server <23.3
+ALTER TABLE t DELETE WHERE x = 1;
+-- @end
+SELECT 1;
+`
+
+func TestSelectServerBlocks(t *testing.T) {
+	tests := []struct {
+		server  []int
+		kept    string
+		dropped string
+	}{
+		{[]int{24, 3}, "DELETE FROM t", "ALTER TABLE t DELETE"},
+		{[]int{22, 8}, "ALTER TABLE t DELETE", "DELETE FROM t"},
+	}
+
+	for _, tt := range tests {
+		sql, err := selectServerBlocks(serverBlockSQL, tt.server)
+		if err != nil {
+			t.Fatalf("selectServerBlocks failed: %v", err)
+		}
+		if !strings.Contains(sql, tt.kept) || strings.Contains(sql, tt.dropped) {
+			t.Errorf("server %v: expected %q kept and %q dropped, got %q", tt.server, tt.kept, tt.dropped, sql)
+		}
+		if !strings.Contains(sql, "CREATE TABLE t") || !strings.Contains(sql, "SELECT 1") || strings.Contains(sql, "@server") {
+			t.Errorf("server %v: expected shared lines kept and markers dropped, got %q", tt.server, sql)
+		}
+	}
+}
+
+func TestSelectServerBlocksErrors(t *testing.T) {
+	tests := []struct {
+		sql      string
+		server   []int
+		contains string
+	}{
+		{"-- @server >=24.3\nSELECT 1;\n", []int{24, 3}, "without -- @end"},
+		{"SELECT 1;\n-- @end\n", []int{24, 3}, "line 2: -- @end without"},
+		{"-- @server 24.3\nSELECT 1;\n-- @end\n", []int{24, 3}, "line 1: invalid server version constraint"},
+		{"-- @server >=24.3\nSELECT 1;\n-- @end\n", nil, "need the server version"},
+	}
+
+	for _, tt := range tests {
+		_, err := selectServerBlocks(tt.sql, tt.server)
+		if err == nil || !strings.Contains(err.Error(), tt.contains) {
+			t.Errorf("sql %q: expected error containing %q, got %v", tt.sql, tt.contains, err)
+		}
+	}
+}
+
+// ============================================================================
+// Tests for server requirements in run
+// ============================================================================
+
+func TestRunRequiresServer(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE t (x UInt8);\n")
+	writeTestFile(t, dir, "002.sql", "-- version: 1.0.1\n-- requires-server: >=24.3\nALTER TABLE t ADD COLUMN j JSON;\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n002.sql\n")
+
+	var stdout, stderr bytes.Buffer
+	mock := &serverMock{version: "23.8.2.7"}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "002.sql requires server version >=24.3, but the server runs 23.8.2.7") {
+		t.Errorf("expected server version error, got %q", stderr.String())
+	}
+	if len(migrationStatements(mock.executedSQL)) != 0 {
+		t.Errorf("expected nothing to be executed, got %v", mock.executedSQL)
+	}
+}
+
+func TestRunServerBlocks(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\n-- requires-server: >=22.8\n"+serverBlockSQL)
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+
+	var stdout, stderr bytes.Buffer
+	mock := &serverMock{version: "24.3.1.2672"}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	statements := strings.Join(migrationStatements(mock.executedSQL), "\n")
+	if !strings.Contains(statements, "DELETE FROM t") || strings.Contains(statements, "ALTER TABLE t DELETE") {
+		t.Errorf("expected the >=23.3 block to run, got %q", statements)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+)
+
+// States reported by -status
+const (
+	stateApplied     = "applied"
+	statePending     = "pending"
+	stateModified    = "modified"
+	stateMissing     = "missing"
+	stateFailed      = "failed"
+	stateUntracked   = "untracked"
+	stateExcluded    = "excluded"
+	stateInterrupted = "interrupted"
+)
+
+// MigrationStatus describes one migration as seen by -status
+type MigrationStatus struct {
+	Version   string
+	Filename  string
+	State     string
+	AppliedAt time.Time
+	Duration  time.Duration
+}
+
+// buildMigrationStatus joins the migrations from the index against the schema_versions records.
+// Migrations are listed in index order, followed by applied versions no longer in the index.
+// Unapplied migrations whose tags do not match the active tags are reported as excluded.
+func buildMigrationStatus(migrations []MigrationInfo, records []MigrationRecord, tags []string) []MigrationStatus {
+	latest := latestMigrationRecords(records)
+	inIndex := make(map[string]bool)
+
+	var result []MigrationStatus
+	for _, info := range migrations {
+		status := MigrationStatus{
+			Version:  info.Version,
+			Filename: info.Filename,
+		}
+
+		record, exists := latest[info.Version]
+		switch {
+		case info.Version == "":
+			status.State = stateUntracked
+		case !exists && !migrationIncluded(info, tags):
+			status.State = stateExcluded
+		case !exists:
+			status.State = statePending
+		case record.Status == statusFailed:
+			status.State = stateFailed
+		case record.Status == statusInterrupted:
+			status.State = stateInterrupted
+		case record.Checksum != info.Checksum:
+			status.State = stateModified
+		default:
+			status.State = stateApplied
+		}
+		if exists {
+			status.AppliedAt = record.AppliedAt
+			status.Duration = record.Duration
+		}
+
+		inIndex[info.Version] = true
+		result = append(result, status)
+	}
+
+	// Applied versions that are no longer listed in the index, in the order they were applied
+	for _, record := range records {
+		if inIndex[record.Version] || latest[record.Version] != record {
+			continue
+		}
+		result = append(result, MigrationStatus{
+			Version:   record.Version,
+			Filename:  record.Filename,
+			State:     stateMissing,
+			AppliedAt: record.AppliedAt,
+			Duration:  record.Duration,
+		})
+	}
+
+	return result
+}
+
+// statusNeedsAction reports whether any migration is pending, modified, failed or interrupted
+func statusNeedsAction(statuses []MigrationStatus) bool {
+	for _, status := range statuses {
+		switch status.State {
+		case statePending, stateModified, stateFailed, stateInterrupted:
+			return true
+		}
+	}
+	return false
+}
+
+// countStatusStates returns the number of migrations in each state
+func countStatusStates(statuses []MigrationStatus) map[string]int {
+	counts := map[string]int{
+		stateApplied:     0,
+		statePending:     0,
+		stateModified:    0,
+		stateFailed:      0,
+		stateMissing:     0,
+		stateUntracked:   0,
+		stateExcluded:    0,
+		stateInterrupted: 0,
+	}
+	for _, status := range statuses {
+		counts[status.State]++
+	}
+	return counts
+}
+
+// showStatusWithWriter prints a table of migration states and returns the exit code:
+// 0 when everything is applied, 1 when anything is pending, modified, failed or interrupted
+func showStatusWithWriter(statuses []MigrationStatus, logger *Logger) int {
+	if len(statuses) == 0 {
+		logger.Printf("No migrations found in index.")
+		return 0
+	}
+
+	tw := tabwriter.NewWriter(logger.out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tSTATE\tAPPLIED AT\tDURATION\tFILE")
+	for _, status := range statuses {
+		version := status.Version
+		if version == "" {
+			version = "-"
+		}
+		appliedAt := "-"
+		if !status.AppliedAt.IsZero() {
+			appliedAt = status.AppliedAt.Format("2006-01-02 15:04:05")
+		}
+		duration := "-"
+		if status.Duration > 0 {
+			duration = status.Duration.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", version, status.State, appliedAt, duration, status.Filename)
+	}
+	tw.Flush()
+
+	counts := countStatusStates(statuses)
+	logger.Printf("")
+	logger.Printf("%d applied, %d pending, %d modified, %d failed, %d interrupted, %d missing, %d untracked, %d excluded",
+		counts[stateApplied], counts[statePending], counts[stateModified], counts[stateFailed],
+		counts[stateInterrupted], counts[stateMissing], counts[stateUntracked], counts[stateExcluded])
+
+	if statusNeedsAction(statuses) {
+		logger.Printf("%s", logger.paint(colorYellow, "Schema is not up to date"))
+		return 1
+	}
+	logger.Printf("%s", logger.paint(colorGreen, "✓ Schema is up to date"))
+	return 0
+}
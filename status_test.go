@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ============================================================================
+// Tests for buildMigrationStatus
+// ============================================================================
+
+func TestBuildMigrationStatus(t *testing.T) {
+	appliedAt := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	migrations := []MigrationInfo{
+		{Version: "1.0.0", Filename: "001.sql", Checksum: "aaa"},
+		{Version: "1.0.1", Filename: "002.sql", Checksum: "bbb"},
+		{Version: "1.0.2", Filename: "003.sql", Checksum: "ccc"},
+		{Version: "1.0.3", Filename: "004.sql", Checksum: "ddd"},
+		{Version: "", Filename: "grants.sql", Checksum: "eee"},
+	}
+	records := []MigrationRecord{
+		{Version: "0.9.0", Filename: "old.sql", Checksum: "zzz", Status: statusApplied, AppliedAt: appliedAt},
+		{Version: "1.0.0", Filename: "001.sql", Checksum: "aaa", Status: statusApplied, AppliedAt: appliedAt, Duration: 120 * time.Millisecond},
+		{Version: "1.0.1", Filename: "002.sql", Checksum: "old", Status: statusApplied, AppliedAt: appliedAt},
+		{Version: "1.0.2", Filename: "003.sql", Checksum: "ccc", Status: statusFailed, AppliedAt: appliedAt},
+	}
+
+	statuses := buildMigrationStatus(migrations, records, nil)
+
+	expected := []struct {
+		version string
+		state   string
+	}{
+		{"1.0.0", stateApplied},
+		{"1.0.1", stateModified},
+		{"1.0.2", stateFailed},
+		{"1.0.3", statePending},
+		{"", stateUntracked},
+		{"0.9.0", stateMissing},
+	}
+
+	if len(statuses) != len(expected) {
+		t.Fatalf("expected %d statuses, got %d: %+v", len(expected), len(statuses), statuses)
+	}
+	for i, e := range expected {
+		if statuses[i].Version != e.version || statuses[i].State != e.state {
+			t.Errorf("status %d: expected %s/%s, got %s/%s", i, e.version, e.state, statuses[i].Version, statuses[i].State)
+		}
+	}
+
+	if statuses[0].Duration != 120*time.Millisecond {
+		t.Errorf("expected duration to be carried over, got %v", statuses[0].Duration)
+	}
+	if !statuses[0].AppliedAt.Equal(appliedAt) {
+		t.Errorf("expected applied time to be carried over, got %v", statuses[0].AppliedAt)
+	}
+}
+
+func TestBuildMigrationStatusLatestRecordWins(t *testing.T) {
+	migrations := []MigrationInfo{
+		{Version: "1.0.0", Filename: "001.sql", Checksum: "aaa"},
+	}
+	records := []MigrationRecord{
+		{Version: "1.0.0", Checksum: "aaa", Status: statusFailed},
+		{Version: "1.0.0", Checksum: "aaa", Status: statusApplied},
+	}
+
+	statuses := buildMigrationStatus(migrations, records, nil)
+	if len(statuses) != 1 || statuses[0].State != stateApplied {
+		t.Errorf("expected a single applied status, got %+v", statuses)
+	}
+}
+
+// ============================================================================
+// Tests for showStatusWithWriter
+// ============================================================================
+
+func TestShowStatusWithWriterUpToDate(t *testing.T) {
+	var stdout bytes.Buffer
+	statuses := []MigrationStatus{
+		{Version: "1.0.0", Filename: "001.sql", State: stateApplied},
+		{Version: "0.9.0", Filename: "old.sql", State: stateMissing},
+	}
+
+	exitCode := showStatusWithWriter(statuses, testLogger(&stdout))
+	if exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", exitCode)
+	}
+
+	output := stdout.String()
+	if !strings.Contains(output, "VERSION") || !strings.Contains(output, "001.sql") {
+		t.Errorf("expected status table, got %q", output)
+	}
+	if !strings.Contains(output, "Schema is up to date") {
+		t.Errorf("expected up to date message, got %q", output)
+	}
+}
+
+func TestShowStatusWithWriterPending(t *testing.T) {
+	var stdout bytes.Buffer
+	statuses := []MigrationStatus{
+		{Version: "1.0.0", Filename: "001.sql", State: stateApplied},
+		{Version: "1.0.1", Filename: "002.sql", State: statePending},
+	}
+
+	exitCode := showStatusWithWriter(statuses, testLogger(&stdout))
+	if exitCode != 1 {
+		t.Errorf("expected exit code 1 with pending migrations, got %d", exitCode)
+	}
+	if !strings.Contains(stdout.String(), "1 applied, 1 pending") {
+		t.Errorf("expected counts in output, got %q", stdout.String())
+	}
+}
+
+func TestShowStatusWithWriterEmpty(t *testing.T) {
+	var stdout bytes.Buffer
+
+	if exitCode := showStatusWithWriter(nil, testLogger(&stdout)); exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", exitCode)
+	}
+	if !strings.Contains(stdout.String(), "No migrations found") {
+		t.Errorf("expected empty message, got %q", stdout.String())
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	indexPath := writeMigrationTree(t, "1.0.0", "1.0.1")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutorWithRows{
+		rows: []map[string]interface{}{},
+	}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-status"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Errorf("expected exit code 1 with pending migrations, got %d", exitCode)
+	}
+	if len(mock.executedSQL) != 0 {
+		t.Errorf("status should not execute anything, got %v", mock.executedSQL)
+	}
+	if !strings.Contains(stdout.String(), "0 applied, 2 pending") {
+		t.Errorf("expected pending migrations in output, got %q", stdout.String())
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+)
+
+// parseTags splits a comma-separated tag list into lower-case tags
+func parseTags(s string) []string {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// activeTags returns the tags selected for this run: -tags, or the -env name when
+// no tags are given
+func activeTags(cfg RunConfig) []string {
+	if cfg.Tags != "" {
+		return parseTags(cfg.Tags)
+	}
+	return parseTags(cfg.Env)
+}
+
+// migrationIncluded reports whether a migration runs with the active tags.
+// Untagged migrations always run; tagged ones need at least one matching tag.
+func migrationIncluded(info MigrationInfo, active []string) bool {
+	if len(info.Tags) == 0 {
+		return true
+	}
+	for _, tag := range info.Tags {
+		for _, a := range active {
+			if tag == a {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// Tests for tag parsing and matching
+// ============================================================================
+
+func TestParseTags(t *testing.T) {
+	tags := parseTags(" Dev, test ,,PROD")
+	if !reflect.DeepEqual(tags, []string{"dev", "test", "prod"}) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+	if tags := parseTags(""); tags != nil {
+		t.Errorf("expected no tags, got %v", tags)
+	}
+}
+
+func TestParseMigrationInfoTags(t *testing.T) {
+	path := writeTestFile(t, t.TempDir(), "001.sql", "-- version: 1.0.0\n-- description: Fixtures\n-- tags: dev, test\nINSERT INTO t VALUES (1);\n")
+
+	info, err := parseMigrationInfo(path)
+	if err != nil {
+		t.Fatalf("parseMigrationInfo failed: %v", err)
+	}
+	if !reflect.DeepEqual(info.Tags, []string{"dev", "test"}) {
+		t.Errorf("unexpected tags %v", info.Tags)
+	}
+}
+
+func TestActiveTags(t *testing.T) {
+	if tags := activeTags(RunConfig{Env: "prod"}); !reflect.DeepEqual(tags, []string{"prod"}) {
+		t.Errorf("expected tags to default to the environment, got %v", tags)
+	}
+	if tags := activeTags(RunConfig{Env: "prod", Tags: "ci,test"}); !reflect.DeepEqual(tags, []string{"ci", "test"}) {
+		t.Errorf("expected -tags to win over the environment, got %v", tags)
+	}
+}
+
+func TestMigrationIncluded(t *testing.T) {
+	tests := []struct {
+		tags     []string
+		active   []string
+		included bool
+	}{
+		{nil, nil, true},
+		{nil, []string{"prod"}, true},
+		{[]string{"dev", "test"}, []string{"test"}, true},
+		{[]string{"dev", "test"}, []string{"prod"}, false},
+		{[]string{"dev"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		if included := migrationIncluded(MigrationInfo{Tags: tt.tags}, tt.active); included != tt.included {
+			t.Errorf("migrationIncluded(%v, %v) = %v, expected %v", tt.tags, tt.active, included, tt.included)
+		}
+	}
+}
+
+// ============================================================================
+// Tests for tagged migrations in run
+// ============================================================================
+
+// writeTaggedTree writes an untagged, a dev-only and a prod-only migration
+func writeTaggedTree(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	writeTestFile(t, dir, "002.sql", "-- version: 1.0.1\n-- tags: dev,test\nINSERT INTO a VALUES (1);\n")
+	writeTestFile(t, dir, "003.sql", "-- version: 1.0.2\n-- tags: prod\nCREATE TABLE b (x UInt8);\n")
+	return writeTestFile(t, dir, "index.lst", "001.sql\n002.sql\n003.sql\n")
+}
+
+func TestRunExcludesTaggedMigrations(t *testing.T) {
+	indexPath := writeTaggedTree(t)
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-tags", "dev", "-output", "json"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	statements := migrationStatements(mock.executedSQL)
+	if len(statements) != 2 || strings.Contains(strings.Join(statements, "\n"), "CREATE TABLE b") {
+		t.Errorf("expected the prod migration to be excluded, got %v", statements)
+	}
+	for _, sql := range mock.executedSQL {
+		if strings.Contains(sql, "'1.0.2'") {
+			t.Errorf("excluded migration should not be recorded: %s", sql)
+		}
+	}
+	if !strings.Contains(stdout.String(), `"excluded": [
+      "003.sql"
+    ]`) {
+		t.Errorf("expected excluded file in JSON report, got %s", stdout.String())
+	}
+}
+
+func TestRunTagsFromEnvironment(t *testing.T) {
+	indexPath := writeTaggedTree(t)
+	path := writeTestFile(t, t.TempDir(), "dbmigrate.yaml", "path: "+indexPath+"\nenvironments:\n  prod:\n    host: ch-prod\n")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-config", path, "-env", "prod"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	statements := strings.Join(migrationStatements(mock.executedSQL), "\n")
+	if strings.Contains(statements, "INSERT INTO a") || !strings.Contains(statements, "CREATE TABLE b") {
+		t.Errorf("expected only the prod migration to run, got %v", statements)
+	}
+	if !strings.Contains(stdout.String(), "Excluded 1 file(s) by tags") {
+		t.Errorf("expected excluded summary, got %q", stdout.String())
+	}
+}
+
+func TestBuildMigrationStatusExcluded(t *testing.T) {
+	migrations := []MigrationInfo{
+		{Version: "1.0.0", Checksum: "aaa", Tags: []string{"dev"}},
+		{Version: "1.0.1", Checksum: "bbb", Tags: []string{"dev"}},
+		{Version: "1.0.2", Checksum: "ccc", Tags: []string{"prod"}},
+	}
+	records := []MigrationRecord{
+		{Version: "1.0.0", Checksum: "aaa", Status: statusApplied},
+	}
+
+	statuses := buildMigrationStatus(migrations, records, []string{"prod"})
+
+	expected := []string{stateApplied, stateExcluded, statePending}
+	for i, state := range expected {
+		if statuses[i].State != state {
+			t.Errorf("status %d: expected %s, got %s", i, state, statuses[i].State)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// Checksum modes selected with -checksum
+const (
+	checksumSource   = "source"   // Checksum the file as written; variable values may change freely
+	checksumRendered = "rendered" // Checksum the SQL after substitution; changed values count as a modified migration
+)
+
+// varEnvPrefix marks environment variables that provide template variables,
+// e.g. DBMIGRATE_VAR_TTL_DAYS=30 sets ${ttl_days}
+const varEnvPrefix = "DBMIGRATE_VAR_"
+
+// templateVarRegex matches ${name} references; $${name} is an escaped literal
+var templateVarRegex = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// varFlag collects repeated -var name=value flags
+type varFlag map[string]string
+
+func (v varFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for name, value := range v {
+		pairs = append(pairs, name+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v varFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected name=value, got %q", s)
+	}
+	v[name] = value
+	return nil
+}
+
+// loadVarsFile reads template variables from a flat YAML file of name: value pairs
+func loadVarsFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vars file: %w", err)
+	}
+	vars := make(map[string]string)
+	if err := yaml.Unmarshal(data, &vars); err != nil {
+		return nil, fmt.Errorf("failed to parse vars file %s: %w", path, err)
+	}
+	return vars, nil
+}
+
+// templateVars merges the variables available to migrations, later sources winning:
+// the built-in ${db}, the vars file, DBMIGRATE_VAR_* environment variables and -var flags
+func templateVars(cfg RunConfig) (map[string]string, error) {
+	vars := map[string]string{"db": cfg.Database}
+
+	if cfg.VarsFile != "" {
+		fileVars, err := loadVarsFile(cfg.VarsFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range fileVars {
+			vars[name] = value
+		}
+	}
+
+	for _, entry := range os.Environ() {
+		key, value, _ := strings.Cut(entry, "=")
+		if name, ok := strings.CutPrefix(key, varEnvPrefix); ok && name != "" {
+			vars[strings.ToLower(name)] = value
+		}
+	}
+
+	for name, value := range cfg.Vars {
+		vars[name] = value
+	}
+	return vars, nil
+}
+
+// renderSQL substitutes ${name} references in sql. $${name} is written out as ${name}.
+// Referencing a variable that has no value is an error in SQL code; inside comments
+// and quoted strings such a reference is left as written, so text that merely
+// looks like a reference keeps working.
+func renderSQL(sql string, vars map[string]string) (string, error) {
+	missing := make(map[string]bool)
+	var rendered strings.Builder
+	var scan sqlScanState
+	last := 0
+	for _, loc := range templateVarRegex.FindAllStringIndex(sql, -1) {
+		scan.advance(sql[last:loc[0]])
+		rendered.WriteString(sql[last:loc[0]])
+		last = loc[1]
+
+		ref := sql[loc[0]:loc[1]]
+		if strings.HasPrefix(ref, "$$") {
+			rendered.WriteString(ref[1:])
+			continue
+		}
+		name := ref[2 : len(ref)-1]
+		value, ok := vars[name]
+		if !ok {
+			if scan.inCode() {
+				missing[name] = true
+			}
+			value = ref
+		}
+		rendered.WriteString(value)
+	}
+	rendered.WriteString(sql[last:])
+
+	if len(missing) > 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("undefined variable(s): %s (set with -var, -vars-file or %s<NAME>)", strings.Join(names, ", "), varEnvPrefix)
+	}
+	return rendered.String(), nil
+}
+
+// sqlScanState tracks whether a position in SQL text is inside a quoted string or
+// a comment, following the same rules as splitSQLStatements
+type sqlScanState struct {
+	singleQuote, doubleQuote  bool
+	lineComment, blockComment bool
+	prev                      rune // Last rune scanned, for \ escapes and two-rune markers
+}
+
+// inCode reports whether the scanned text ends outside strings and comments
+func (s *sqlScanState) inCode() bool {
+	return !s.singleQuote && !s.doubleQuote && !s.lineComment && !s.blockComment
+}
+
+// advance scans text following what was scanned so far
+func (s *sqlScanState) advance(text string) {
+	for _, ch := range text {
+		prev := s.prev
+		s.prev = ch
+		switch {
+		case s.lineComment:
+			if ch == '\n' || ch == '\r' {
+				s.lineComment = false
+			}
+		case s.blockComment:
+			if prev == '*' && ch == '/' {
+				s.blockComment = false
+				s.prev = 0 // The '/' cannot start another marker
+			}
+		case s.singleQuote:
+			if ch == '\'' && prev != '\\' {
+				s.singleQuote = false
+			}
+		case s.doubleQuote:
+			if ch == '"' && prev != '\\' {
+				s.doubleQuote = false
+			}
+		case prev == '-' && ch == '-':
+			s.lineComment = true
+		case prev == '/' && ch == '*':
+			s.blockComment = true
+			s.prev = 0 // The '*' cannot end the comment
+		case ch == '\'':
+			s.singleQuote = true
+		case ch == '"':
+			s.doubleQuote = true
+		}
+	}
+}
+
+// renderSQLFile reads a migration file and substitutes its variables
+func renderSQLFile(path string, vars map[string]string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read SQL file: %w", err)
+	}
+	return renderSQL(string(content), vars)
+}
+
+// sqlSource loads migration files as they are executed: variables substituted and,
+// once the server version is known, only the matching -- @server blocks kept
+type sqlSource struct {
+	vars   map[string]string
+	server []int
+}
+
+// load returns the SQL to execute for a migration file
+func (s sqlSource) load(path string) (string, error) {
+	sql, err := renderSQLFile(path, s.vars)
+	if err != nil {
+		return "", err
+	}
+	return selectServerBlocks(sql, s.server)
+}
+
+// sqlChecksum returns the checksum recorded in schema_versions for SQL content
+func sqlChecksum(sql string) string {
+	hash := md5.Sum([]byte(sql))
+	return hex.EncodeToString(hash[:])
+}
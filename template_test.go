@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ============================================================================
+// Tests for renderSQL
+// ============================================================================
+
+func TestRenderSQL(t *testing.T) {
+	vars := map[string]string{"db": "analytics", "ttl_days": "30"}
+
+	rendered, err := renderSQL("CREATE TABLE ${db}.events (d Date) ENGINE = MergeTree ORDER BY d TTL d + INTERVAL ${ttl_days} DAY;", vars)
+	if err != nil {
+		t.Fatalf("renderSQL failed: %v", err)
+	}
+	expected := "CREATE TABLE analytics.events (d Date) ENGINE = MergeTree ORDER BY d TTL d + INTERVAL 30 DAY;"
+	if rendered != expected {
+		t.Errorf("expected %q, got %q", expected, rendered)
+	}
+}
+
+func TestRenderSQLEscape(t *testing.T) {
+	rendered, err := renderSQL("SELECT '$${literal}', '${db}', '$5'", map[string]string{"db": "x"})
+	if err != nil {
+		t.Fatalf("renderSQL failed: %v", err)
+	}
+	if rendered != "SELECT '${literal}', 'x', '$5'" {
+		t.Errorf("unexpected rendering %q", rendered)
+	}
+}
+
+func TestRenderSQLUndefined(t *testing.T) {
+	_, err := renderSQL("SELECT ${b}, ${a}, ${b}", nil)
+	if err == nil || !strings.Contains(err.Error(), "undefined variable(s): a, b") {
+		t.Errorf("expected undefined variables error, got %v", err)
+	}
+}
+
+func TestRenderSQLUndefinedOutsideCode(t *testing.T) {
+	sql := "-- Uses ${legacy} in a comment\n" +
+		"/* and ${block}; */\n" +
+		"SELECT '${literal}', \"${quoted}\", 'it''s ${also}', '\\'${escaped}' FROM ${db}.t;"
+
+	rendered, err := renderSQL(sql, map[string]string{"db": "x"})
+	if err != nil {
+		t.Fatalf("renderSQL failed: %v", err)
+	}
+	expected := strings.Replace(sql, "${db}", "x", 1)
+	if rendered != expected {
+		t.Errorf("expected %q, got %q", expected, rendered)
+	}
+
+	_, err = renderSQL("SELECT '--' AS dashes, ${after_string}", nil)
+	if err == nil || !strings.Contains(err.Error(), "after_string") {
+		t.Errorf("expected undefined variable after a string, got %v", err)
+	}
+}
+
+// ============================================================================
+// Tests for templateVars
+// ============================================================================
+
+func TestTemplateVarsPrecedence(t *testing.T) {
+	varsFile := writeTestFile(t, t.TempDir(), "vars.yaml", "ttl_days: 30\npolicy: hot\nregion: eu\n")
+	t.Setenv("DBMIGRATE_VAR_POLICY", "cold")
+	t.Setenv("DBMIGRATE_VAR_REGION", "us")
+
+	vars, err := templateVars(RunConfig{
+		Database: "analytics",
+		VarsFile: varsFile,
+		Vars:     map[string]string{"region": "ap"},
+	})
+	if err != nil {
+		t.Fatalf("templateVars failed: %v", err)
+	}
+
+	expected := map[string]string{"db": "analytics", "ttl_days": "30", "policy": "cold", "region": "ap"}
+	for name, value := range expected {
+		if vars[name] != value {
+			t.Errorf("expected %s=%q, got %q", name, value, vars[name])
+		}
+	}
+}
+
+func TestTemplateVarsInvalidFile(t *testing.T) {
+	varsFile := writeTestFile(t, t.TempDir(), "vars.yaml", "- not\n- a map\n")
+
+	if _, err := templateVars(RunConfig{VarsFile: varsFile}); err == nil {
+		t.Error("expected error for vars file that is not a map")
+	}
+}
+
+func TestVarFlag(t *testing.T) {
+	cfg, err := parseWithConfig(t, "-var", "ttl_days=30", "-var", "filter=a=b")
+	if err != nil {
+		t.Fatalf("applyConfigLayers failed: %v", err)
+	}
+	if cfg.Vars["ttl_days"] != "30" || cfg.Vars["filter"] != "a=b" {
+		t.Errorf("unexpected vars %v", cfg.Vars)
+	}
+
+	if err := (varFlag{}).Set("novalue"); err == nil {
+		t.Error("expected error for -var without =")
+	}
+}
+
+// ============================================================================
+// Tests for templated migrations in run
+// ============================================================================
+
+func TestRunRendersTemplates(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE ${db}.events (d Date) TTL d + INTERVAL ${ttl_days} DAY;\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-db", "analytics", "-var", "ttl_days=7"},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+	statements := migrationStatements(mock.executedSQL)
+	if len(statements) != 1 || !strings.HasSuffix(statements[0], "CREATE TABLE analytics.events (d Date) TTL d + INTERVAL 7 DAY") {
+		t.Errorf("expected rendered statement, got %v", statements)
+	}
+}
+
+func TestRunUndefinedVariableFailsBeforeExecuting(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	writeTestFile(t, dir, "002.sql", "-- version: 1.0.1\nALTER TABLE a MODIFY TTL ${ttl};\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n002.sql\n")
+
+	var stdout, stderr bytes.Buffer
+	mock := &MockExecutor{}
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath},
+		Executor: mock,
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "002.sql: undefined variable(s): ttl") {
+		t.Errorf("expected undefined variable error, got %q", stderr.String())
+	}
+	if len(migrationStatements(mock.executedSQL)) != 0 {
+		t.Errorf("expected nothing to be executed, got %v", mock.executedSQL)
+	}
+}
+
+func TestRunChecksumModes(t *testing.T) {
+	dir := t.TempDir()
+	source := "-- version: 1.0.0\nCREATE TABLE t (d Date) TTL d + INTERVAL ${ttl} DAY;\n"
+	sqlPath := writeTestFile(t, dir, "001.sql", source)
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+
+	// Recorded with ttl=30 under each mode
+	recordedSource := sqlChecksum(source)
+	rendered, _ := renderSQLFile(sqlPath, map[string]string{"ttl": "30"})
+	recordedRendered := sqlChecksum(rendered)
+
+	tests := []struct {
+		mode     string
+		checksum string
+		exitCode int
+	}{
+		{checksumSource, recordedSource, 0},
+		{checksumRendered, recordedRendered, 1},
+	}
+
+	for _, tt := range tests {
+		var stdout, stderr bytes.Buffer
+		mock := &MockExecutorWithRows{
+			rows: []map[string]interface{}{
+				{"version": "1.0.0", "checksum": tt.checksum},
+			},
+		}
+		cfg := RunConfig{
+			Stdout:   &stdout,
+			Stderr:   &stderr,
+			Args:     []string{"-path", indexPath, "-var", "ttl=90", "-checksum", tt.mode},
+			Executor: mock,
+		}
+
+		if exitCode := run(cfg); exitCode != tt.exitCode {
+			t.Errorf("-checksum %s: expected exit code %d, got %d: %s", tt.mode, tt.exitCode, exitCode, stderr.String())
+		}
+	}
+}
+
+func TestRunInvalidChecksumMode(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", filepath.Join(t.TempDir(), "index.lst"), "-checksum", "both"},
+		Executor: &MockExecutor{},
+	}
+
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Errorf("expected exit code 1, got %d", exitCode)
+	}
+	if !strings.Contains(stderr.String(), "-checksum must be") {
+		t.Errorf("expected checksum mode error, got %q", stderr.String())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the instrumentation scope of dbmigrate's spans
+const tracerName = "github.com/quantumgateway/dbmigrate"
+
+// traceShutdownTimeout bounds how long exporting the remaining spans may delay exit
+const traceShutdownTimeout = 5 * time.Second
+
+// Span attributes
+const (
+	attrRunID        = attribute.Key("dbmigrate.run_id")
+	attrCommand      = attribute.Key("dbmigrate.command")
+	attrVersion      = attribute.Key("dbmigrate.migration.version")
+	attrFile         = attribute.Key("dbmigrate.migration.file")
+	attrStatement    = attribute.Key("dbmigrate.statement.index")
+	attrQueryID      = attribute.Key("dbmigrate.statement.query_id")
+	attrRowsRead     = attribute.Key("dbmigrate.statement.rows_read")
+	attrRowsAffected = attribute.Key("dbmigrate.statement.rows_affected")
+	attrTable        = attribute.Key("dbmigrate.data.table")
+	attrRows         = attribute.Key("dbmigrate.data.rows")
+)
+
+// otlpEndpointEnv are the standard variables that enable OTLP export without -otlp-endpoint
+var otlpEndpointEnv = []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"}
+
+// setupTracing returns the tracer provider for a run: spans go to the OTLP/HTTP
+// endpoint of -otlp-endpoint (or OTEL_EXPORTER_OTLP_ENDPOINT) and/or are written as
+// JSON lines to -trace-file. Without either, spans are not recorded. The returned
+// shutdown function flushes pending spans.
+func setupTracing(cfg RunConfig) (trace.TracerProvider, func(context.Context) error, error) {
+	var exporters []sdktrace.SpanExporter
+
+	endpoint := cfg.OTLPEndpoint
+	useOTLP := endpoint != ""
+	for _, name := range otlpEndpointEnv {
+		useOTLP = useOTLP || os.Getenv(name) != ""
+	}
+	if useOTLP {
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		exporter, err := otlptracehttp.New(context.Background(), opts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+		}
+		exporters = append(exporters, exporter)
+	}
+
+	var traceFile *os.File
+	if cfg.TraceFile != "" {
+		f, err := os.Create(cfg.TraceFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create trace file: %w", err)
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, fmt.Errorf("failed to create trace file exporter: %w", err)
+		}
+		traceFile = f
+		exporters = append(exporters, exporter)
+	}
+
+	if len(exporters) == 0 {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "dbmigrate"),
+		attribute.String("service.version", Version),
+	))
+	if err == nil {
+		res, err = resource.Merge(res, resource.Environment())
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to describe trace resource: %w", err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	for _, exporter := range exporters {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	}
+	provider := sdktrace.NewTracerProvider(opts...)
+
+	shutdown := func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if traceFile != nil {
+			if closeErr := traceFile.Close(); err == nil {
+				err = closeErr
+			}
+		}
+		return err
+	}
+	return provider, shutdown, nil
+}
+
+// startSpan starts a child of the span in ctx, using the same tracer provider.
+// Outside a traced run it returns a non-recording span.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err, if any, on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// statementStatsKey is the context key for the row counts of a statement
+type statementStatsKey struct{}
+
+// statementStats collects the rows a statement read and wrote, from the server's progress packets
+type statementStats struct {
+	mu          sync.Mutex
+	readRows    uint64
+	writtenRows uint64
+}
+
+// add counts the rows of one progress packet
+func (s *statementStats) add(read, written uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readRows += read
+	s.writtenRows += written
+}
+
+// attributes returns the row counts as span attributes
+func (s *statementStats) attributes() []attribute.KeyValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return []attribute.KeyValue{
+		attrRowsRead.Int64(int64(s.readRows)),
+		attrRowsAffected.Int64(int64(s.writtenRows)),
+	}
+}
+
+// withStatementStats returns a context that makes the executor count the rows of its statement in stats
+func withStatementStats(ctx context.Context, stats *statementStats) context.Context {
+	return context.WithValue(ctx, statementStatsKey{}, stats)
+}
+
+// statementStatsFrom returns the counter attached with withStatementStats, if any
+func statementStatsFrom(ctx context.Context) *statementStats {
+	stats, _ := ctx.Value(statementStatsKey{}).(*statementStats)
+	return stats
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// exportedSpan is the part of a -trace-file span the tests look at
+type exportedSpan struct {
+	Name        string
+	SpanContext struct{ SpanID string }
+	Parent      struct{ SpanID string }
+	Attributes  []struct {
+		Key   string
+		Value struct{ Value interface{} }
+	}
+	Status struct{ Code string }
+}
+
+func (s exportedSpan) attr(key string) interface{} {
+	for _, a := range s.Attributes {
+		if a.Key == key {
+			return a.Value.Value
+		}
+	}
+	return nil
+}
+
+// readTraceFile parses the JSON lines of a -trace-file
+func readTraceFile(t *testing.T, path string) []exportedSpan {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open trace file: %v", err)
+	}
+	defer f.Close()
+
+	var spans []exportedSpan
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var span exportedSpan
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			t.Fatalf("failed to parse span %s: %v", scanner.Text(), err)
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+func TestRunTraceFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\nCREATE TABLE b (x UInt8);\n")
+	writeTestFile(t, dir, "002.sql", "-- version: 1.0.1\nCREATE TABLE c (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n002.sql\n")
+	tracePath := filepath.Join(dir, "trace.json")
+
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-trace-file", tracePath},
+		Executor: &interruptExecutor{},
+	}
+	if exitCode := run(cfg); exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+	}
+
+	spans := readTraceFile(t, tracePath)
+	byName := make(map[string][]exportedSpan)
+	for _, span := range spans {
+		byName[span.Name] = append(byName[span.Name], span)
+	}
+	if len(byName["dbmigrate.run"]) != 1 || len(byName["dbmigrate.migration"]) != 2 || len(byName["dbmigrate.statement"]) != 3 {
+		t.Fatalf("expected 1 run, 2 migration and 3 statement spans, got %v", spanNames(spans))
+	}
+
+	runSpan := byName["dbmigrate.run"][0]
+	if runSpan.attr("dbmigrate.run_id") == nil || runSpan.attr("dbmigrate.applied") != float64(2) {
+		t.Errorf("expected run ID and applied count on the run span, got %+v", runSpan.Attributes)
+	}
+
+	migrations := make(map[string]exportedSpan)
+	for _, span := range byName["dbmigrate.migration"] {
+		if span.Parent.SpanID != runSpan.SpanContext.SpanID {
+			t.Errorf("expected migration span to be a child of the run span")
+		}
+		migrations[span.SpanContext.SpanID] = span
+	}
+	for _, span := range byName["dbmigrate.statement"] {
+		parent, ok := migrations[span.Parent.SpanID]
+		if !ok {
+			t.Fatalf("expected statement span to be a child of a migration span")
+		}
+		if span.attr("dbmigrate.migration.version") != parent.attr("dbmigrate.migration.version") {
+			t.Errorf("expected statement version %v to match its migration %v",
+				span.attr("dbmigrate.migration.version"), parent.attr("dbmigrate.migration.version"))
+		}
+		queryID, _ := span.attr("dbmigrate.statement.query_id").(string)
+		if !strings.HasPrefix(queryID, runSpan.attr("dbmigrate.run_id").(string)+"-") {
+			t.Errorf("expected statement query ID to start with the run ID, got %q", queryID)
+		}
+		if span.attr("dbmigrate.statement.index") == nil || span.attr("dbmigrate.statement.rows_affected") == nil {
+			t.Errorf("expected statement index and rows affected, got %+v", span.Attributes)
+		}
+	}
+}
+
+func TestRunTraceFileRecordsFailure(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "001.sql", "-- version: 1.0.0\nCREATE TABLE a (x UInt8);\n")
+	indexPath := writeTestFile(t, dir, "index.lst", "001.sql\n")
+	tracePath := filepath.Join(dir, "trace.json")
+
+	mock := &flakyExecutor{failures: 10, err: errors.New("syntax error")}
+	var stdout, stderr bytes.Buffer
+	cfg := RunConfig{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Args:     []string{"-path", indexPath, "-trace-file", tracePath},
+		Executor: mock,
+	}
+	if exitCode := run(cfg); exitCode != 1 {
+		t.Fatalf("expected exit code 1, got %d", exitCode)
+	}
+
+	for _, span := range readTraceFile(t, tracePath) {
+		if span.Status.Code != "Error" {
+			t.Errorf("expected %s span to record the error, got status %q", span.Name, span.Status.Code)
+		}
+	}
+}
+
+func TestRunTraceFileTextCommands(t *testing.T) {
+	for _, command := range []string{"-version", "-status"} {
+		t.Run(command, func(t *testing.T) {
+			dir := t.TempDir()
+			indexPath := writeTestFile(t, dir, "index.lst", "")
+			tracePath := filepath.Join(dir, "trace.json")
+
+			var stdout, stderr bytes.Buffer
+			cfg := RunConfig{
+				Stdout:   &stdout,
+				Stderr:   &stderr,
+				Args:     []string{"-path", indexPath, "-trace-file", tracePath, command},
+				Executor: &MockExecutor{},
+			}
+			if exitCode := run(cfg); exitCode != 0 {
+				t.Fatalf("expected exit code 0, got %d: %s", exitCode, stderr.String())
+			}
+
+			spans := readTraceFile(t, tracePath)
+			if len(spans) != 1 || spans[0].Name != "dbmigrate.run" {
+				t.Errorf("expected the run span to be exported, got %v", spanNames(spans))
+			}
+		})
+	}
+}
+
+func spanNames(spans []exportedSpan) []string {
+	names := make([]string, len(spans))
+	for i, span := range spans {
+		names[i] = span.Name
+	}
+	return names
+}